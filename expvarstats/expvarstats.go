@@ -0,0 +1,187 @@
+// Package expvarstats periodically publishes the numeric expvar variables through a statsd client.
+//
+//	bridge := expvarstats.New(client, 10*time.Second, expvarstats.WithDeny("memstats.*", "cmdline"))
+//	defer bridge.Close()
+//
+// Nested maps are flattened into dotted bucket names, each key becoming a segment sanitized with
+// statsdclient.SanitizeSegment: the "hits" key of the "cache.stats" map is sent to "expvar.cache_stats.hits".
+// Values are sent as gauges, rounded to integers, unless they match WithCounters.
+package expvarstats
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/internal/ticker"
+)
+
+// Default bucket prefix
+const DefaultPrefix = "expvar"
+
+// An Option configures a Bridge.
+type Option func(*Bridge)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(b *Bridge) { b.prefix = prefix }
+}
+
+// WithAllow only publishes the variables whose flattened name, without the prefix, matches one of
+// patterns, using the syntax of path.Match: "cache.*" matches both "cache.hits" and "cache.stats.misses".
+func WithAllow(patterns ...string) Option {
+	return func(b *Bridge) { b.allow = append(b.allow, patterns...) }
+}
+
+// WithDeny does not publish the variables whose flattened name matches one of patterns.
+// It takes precedence over WithAllow.
+func WithDeny(patterns ...string) Option {
+	return func(b *Bridge) { b.deny = append(b.deny, patterns...) }
+}
+
+// WithCounters sends the variables whose flattened name matches one of patterns as counters of
+// how much they grew since the previous collection, for values that only ever increase.
+// The first collection of a variable only records its value, so that a restart does not send
+// everything counted so far. A value that decreased is taken to have been reset, and is sent as it is.
+func WithCounters(patterns ...string) Option {
+	return func(b *Bridge) { b.counters = append(b.counters, patterns...) }
+}
+
+// A Bridge periodically publishes the expvar variables.
+type Bridge struct {
+	client                statsdclient.StatsClient
+	prefix                string
+	allow, deny, counters []string
+
+	// Guards previous, so that Collect can be called while the bridge runs
+	m sync.Mutex
+	// The values of counters as of the previous collection
+	previous map[string]int64
+
+	ticker *ticker.Ticker
+}
+
+// New returns a bridge that walks the expvar variables every interval and publishes those allowed by its options.
+func New(client statsdclient.StatsClient, interval time.Duration, opts ...Option) *Bridge {
+	b := &Bridge{
+		client:   client,
+		prefix:   DefaultPrefix,
+		previous: map[string]int64{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.prefix != "" {
+		b.prefix += "."
+	}
+
+	b.ticker = ticker.Start(interval, b.Collect)
+	return b
+}
+
+// Close stops the bridge. The expvar variables stay published by the expvar package.
+func (b *Bridge) Close() error {
+	b.ticker.Stop()
+	return nil
+}
+
+// Collect publishes the variables now.
+func (b *Bridge) Collect() {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		// every Var is JSON, which covers Int, Float, Map, Func and custom variables alike
+		decoder := json.NewDecoder(strings.NewReader(kv.Value.String()))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return
+		}
+		b.walk(statsdclient.SanitizeSegment(kv.Key), value)
+	})
+}
+
+// walk publishes value, and the values nested in it, under name.
+func (b *Bridge) walk(name string, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			b.walk(name+"."+statsdclient.SanitizeSegment(key), value[key])
+		}
+	case json.Number:
+		if !b.allowed(name) {
+			return
+		}
+		n, err := value.Int64()
+		if err != nil {
+			f, err := value.Float64()
+			if err != nil {
+				return
+			}
+			n = clamp(math.Round(f))
+		}
+		b.publish(name, n)
+	}
+}
+
+func (b *Bridge) publish(name string, value int64) {
+	if !matchAny(b.counters, name) {
+		if value < 0 {
+			// statsd reads "-N|g" as a change of the previous value, so it is sent as a change of 0
+			b.client.Gauge(b.prefix+name, 0, 1)
+		}
+		b.client.Gauge(b.prefix+name, int(value), 1)
+		return
+	}
+
+	previous, ok := b.previous[name]
+	b.previous[name] = value
+	if !ok {
+		return
+	}
+	delta := value - previous
+	if value < previous {
+		delta = value
+	}
+	if delta != 0 {
+		b.client.Increment(b.prefix+name, int(delta), 1)
+	}
+}
+
+func (b *Bridge) allowed(name string) bool {
+	if len(b.allow) > 0 && !matchAny(b.allow, name) {
+		return false
+	}
+	return !matchAny(b.deny, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func clamp(f float64) int64 {
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
@@ -0,0 +1,133 @@
+package expvarstats
+
+import (
+	"expvar"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+// expvar variables cannot be unpublished, so they are shared by every test
+var (
+	requests = expvar.NewInt("test_requests")
+	cache    = expvar.NewMap("test_cache.stats")
+)
+
+func init() {
+	cache.Add("hits", 10)
+	cache.AddFloat("ratio", 0.75)
+	cache.Set("name", func() *expvar.String { s := new(expvar.String); s.Set("lru"); return s }())
+	expvar.Publish("test_func", expvar.Func(func() interface{} {
+		return map[string]interface{}{"queue": map[string]int{"depth": 3}, "list": []int{1, 2}}
+	}))
+}
+
+func lines(metrics []statsdproto.Metric) []string {
+	var lines []string
+	for _, m := range metrics {
+		lines = append(lines, m.String())
+	}
+	return lines
+}
+
+func TestCollect(t *testing.T) {
+	requests.Set(5)
+	client := statsdclienttest.NewStatsClient()
+	b := New(client, time.Hour, WithAllow("test_*"))
+	defer b.Close()
+	b.Collect()
+
+	expected := []string{
+		"expvar.test_cache_stats.hits:10|g",
+		"expvar.test_cache_stats.ratio:1|g",
+		"expvar.test_func.queue.depth:3|g",
+		"expvar.test_requests:5|g",
+	}
+	got := lines(client.Metrics())
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("got %s, expected %s", got[i], expected[i])
+		}
+	}
+}
+
+func TestFilters(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	b := New(client, time.Hour, WithPrefix("vars"), WithAllow("test_cache_stats.*", "test_requests"), WithDeny("*.ratio"))
+	defer b.Close()
+	b.Collect()
+
+	got := lines(client.Metrics())
+	if len(got) != 2 || got[0] != "vars.test_cache_stats.hits:10|g" || !strings.HasPrefix(got[1], "vars.test_requests:") {
+		t.Errorf("unexpected metrics %v", got)
+	}
+}
+
+func TestCounters(t *testing.T) {
+	requests.Set(5)
+	client := statsdclienttest.NewStatsClient()
+	b := New(client, time.Hour, WithAllow("test_requests"), WithCounters("test_requests"))
+	defer b.Close()
+
+	// the first collection is the baseline
+	b.Collect()
+	requests.Add(3)
+	b.Collect()
+	// no change, nothing sent
+	b.Collect()
+	// a reset
+	requests.Set(2)
+	b.Collect()
+
+	got := lines(client.Metrics())
+	expected := []string{"expvar.test_requests:3|c", "expvar.test_requests:2|c"}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("got %s, expected %s", got[i], expected[i])
+		}
+	}
+}
+
+func TestNegativeGauge(t *testing.T) {
+	requests.Set(-4)
+	defer requests.Set(0)
+	client := statsdclienttest.NewStatsClient()
+	b := New(client, time.Hour, WithAllow("test_requests"))
+	defer b.Close()
+	b.Collect()
+
+	got := lines(client.Metrics())
+	expected := []string{"expvar.test_requests:0|g", "expvar.test_requests:-4|g"}
+	if len(got) != len(expected) || got[0] != expected[0] || got[1] != expected[1] {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	b := New(client, time.Millisecond, WithAllow("test_requests"))
+	deadline := time.Now().Add(time.Second)
+	for len(client.Metrics()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	b.Close()
+
+	n := len(client.Metrics())
+	if n < 2 {
+		t.Fatalf("expected the bridge to run every interval, got %d collections", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if len(client.Metrics()) != n {
+		t.Error("expected no stats after Close")
+	}
+}
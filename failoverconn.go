@@ -0,0 +1,178 @@
+package statsdclient
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRecoveryInterval = 10 * time.Second
+
+	// How long the UDP probe waits for an ICMP port unreachable reply
+	udpProbeTimeout = 100 * time.Millisecond
+)
+
+// failoverConn sends to a primary address and switches to a secondary one while the primary is
+// unreachable. It uses connected UDP sockets, which report the ICMP port unreachable replies of
+// a closed port as ECONNREFUSED on the following write.
+type failoverConn struct {
+	primaryAddr   string
+	secondaryAddr string
+
+	m           sync.Mutex
+	conn        *net.UDPConn
+	onSecondary bool
+
+	check func(addr string) error
+	done  chan struct{}
+}
+
+// errFailoverResolve is returned when a secondary address is combined with the resolve settings.
+var errFailoverResolve = errors.New("Resolve settings cannot be combined with a secondary address")
+
+// errUDPOnly is returned when the resolve or failover settings are combined with TCP.
+var errUDPOnly = errors.New("Resolve and failover settings are only supported over UDP")
+
+// newFailoverConn dials primaryAddr, or secondaryAddr straight away when the primary cannot be dialed.
+func newFailoverConn(primaryAddr, secondaryAddr string, interval time.Duration, check func(addr string) error) (*failoverConn, error) {
+	onSecondary := false
+	conn, err := dialUDP(primaryAddr)
+	if err != nil {
+		var secondaryErr error
+		if conn, secondaryErr = dialUDP(secondaryAddr); secondaryErr != nil {
+			return nil, errors.Join(err, secondaryErr)
+		}
+		onSecondary = true
+	}
+	if interval <= 0 {
+		interval = defaultRecoveryInterval
+	}
+	if check == nil {
+		check = probeUDP
+	}
+
+	f := &failoverConn{
+		primaryAddr:   primaryAddr,
+		secondaryAddr: secondaryAddr,
+		conn:          conn,
+		onSecondary:   onSecondary,
+		check:         check,
+		done:          make(chan struct{}),
+	}
+	go f.tryPrimary(interval)
+	return f, nil
+}
+
+func dialUDP(addr string) (*net.UDPConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.DialUDP("udp", nil, raddr)
+}
+
+// probeUDP sends an empty datagram to addr and fails if the port turns out to be closed.
+// No reply within udpProbeTimeout is taken to mean the server is listening.
+func probeUDP(addr string) error {
+	conn, err := dialUDP(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(nil); err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(udpProbeTimeout))
+	_, err = conn.Read(make([]byte, 1))
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return nil
+}
+
+// TCPHealthCheck returns a health check for Config.HealthCheck that connects to healthAddr over TCP,
+// for servers that expose a TCP port next to their UDP one.
+func TCPHealthCheck(healthAddr string, timeout time.Duration) func(addr string) error {
+	return func(string) error {
+		conn, err := net.DialTimeout("tcp", healthAddr, timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// switchTo replaces the connection with a new one to addr. Must be called with f.m held.
+func (f *failoverConn) switchTo(addr string, secondary bool) error {
+	conn, err := dialUDP(addr)
+	if err != nil {
+		return err
+	}
+	f.conn.Close()
+	f.conn = conn
+	f.onSecondary = secondary
+	return nil
+}
+
+// tryPrimary checks the primary every interval while the secondary is in use, and switches back once it passes.
+func (f *failoverConn) tryPrimary(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+
+		f.m.Lock()
+		onSecondary := f.onSecondary
+		f.m.Unlock()
+		if !onSecondary || f.check(f.primaryAddr) != nil {
+			continue
+		}
+
+		f.m.Lock()
+		if f.onSecondary {
+			f.switchTo(f.primaryAddr, false)
+		}
+		f.m.Unlock()
+	}
+}
+
+func (f *failoverConn) remoteIP() net.IP {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.conn.RemoteAddr().(*net.UDPAddr).IP
+}
+
+func (f *failoverConn) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	n, err := f.conn.Write(p)
+	if err != nil && !f.onSecondary && errors.Is(err, syscall.ECONNREFUSED) {
+		if err := f.switchTo(f.secondaryAddr, true); err != nil {
+			return 0, err
+		}
+		return f.conn.Write(p)
+	}
+	return n, err
+}
+
+// SetWriteDeadline sets the deadline of the writes to the current connection.
+// Switching to the other server clears it.
+func (f *failoverConn) SetWriteDeadline(deadline time.Time) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.conn.SetWriteDeadline(deadline)
+}
+
+func (f *failoverConn) Close() error {
+	close(f.done)
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.conn.Close()
+}
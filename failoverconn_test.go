@@ -0,0 +1,130 @@
+package statsdclient
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// closedUDPAddr returns an address nothing is listening on.
+func closedUDPAddr(t *testing.T) *net.UDPAddr {
+	listener := listenUDP(t)
+	addr := listener.LocalAddr().(*net.UDPAddr)
+	listener.Close()
+	return addr
+}
+
+// sendUntilReceived sends stats through c until listener gets one.
+func sendUntilReceived(t *testing.T, c *Client, listener *net.UDPConn) {
+	for i := 0; i < 100; i++ {
+		c.Increment("incr", 1, 1)
+		c.Flush()
+		for _, line := range readLines(listener) {
+			if line == "incr:1|c" {
+				return
+			}
+		}
+	}
+	t.Fatalf("%s never received a stat", listener.LocalAddr())
+}
+
+func TestFailover(t *testing.T) {
+	primaryAddr := closedUDPAddr(t)
+	secondary := listenUDP(t)
+	defer secondary.Close()
+
+	c, err := DialConfig(Config{
+		Addr:             primaryAddr.String(),
+		SecondaryAddr:    secondary.LocalAddr().String(),
+		RecoveryInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the primary is down, stats move to the secondary
+	sendUntilReceived(t, c, secondary)
+
+	// the primary comes back and passes the recovery probe
+	primary, err := net.ListenUDP("udp", primaryAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	sendUntilReceived(t, c, primary)
+}
+
+func TestFailoverHealthCheck(t *testing.T) {
+	primaryAddr := closedUDPAddr(t)
+	secondary := listenUDP(t)
+	defer secondary.Close()
+
+	checks := make(chan string, 100)
+	c, err := DialConfig(Config{
+		Addr:             primaryAddr.String(),
+		SecondaryAddr:    secondary.LocalAddr().String(),
+		RecoveryInterval: 10 * time.Millisecond,
+		HealthCheck: func(addr string) error {
+			checks <- addr
+			return net.UnknownNetworkError("still down")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sendUntilReceived(t, c, secondary)
+	assert.Equal(t, primaryAddr.String(), <-checks)
+	assert.Equal(t, secondary.LocalAddr().String(), c.conn.(*failoverConn).conn.RemoteAddr().String())
+}
+
+func TestFailoverDialError(t *testing.T) {
+	secondary := listenUDP(t)
+	defer secondary.Close()
+
+	c, err := DialConfig(Config{
+		Addr:          "statsd.invalid:8125",
+		SecondaryAddr: secondary.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sendUntilReceived(t, c, secondary)
+
+	_, err = DialConfig(Config{
+		Addr:          "statsd.invalid:8125",
+		SecondaryAddr: "statsd-secondary.invalid:8125",
+	})
+	assert.NotEqual(t, nil, err)
+
+	_, err = DialConfig(Config{
+		Addr:            "127.0.0.1:8125",
+		SecondaryAddr:   secondary.LocalAddr().String(),
+		ResolveInterval: time.Second,
+	})
+	assert.Equal(t, errFailoverResolve, err)
+
+	_, err = DialConfig(Config{
+		Addr:          "127.0.0.1:8125",
+		Network:       "tcp",
+		SecondaryAddr: secondary.LocalAddr().String(),
+	})
+	assert.Equal(t, errUDPOnly, err)
+}
+
+func TestTCPHealthCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := TCPHealthCheck(listener.Addr().String(), time.Second)
+	assert.Equal(t, nil, check("ignored:8125"))
+
+	listener.Close()
+	assert.NotEqual(t, nil, check("ignored:8125"))
+}
@@ -0,0 +1,11 @@
+module github.com/sendgrid/go-statsdclient
+
+go 1.23
+
+require github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869
+
+require (
+	github.com/kr/pretty v0.3.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/rogpeppe/go-internal v1.9.0 // indirect
+)
@@ -0,0 +1,283 @@
+// Package httpstats records statsd metrics for net/http servers and clients.
+package httpstats
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+)
+
+// Default bucket templates of Middleware
+const (
+	DefaultRequestsBucket = "http.{route}.{method}.requests"
+	DefaultLatencyBucket  = "http.{route}.{method}.latency"
+	DefaultStatusBucket   = "http.{route}.{method}.{status_class}"
+	DefaultBytesBucket    = "http.{route}.{method}.response_bytes"
+	DefaultInFlightBucket = "http.in_flight"
+)
+
+// UnmatchedRoute is the route of requests without a route pattern, unless WithPathNormalizer is used.
+const UnmatchedRoute = "unmatched"
+
+type middlewareConfig struct {
+	requests, latency, status, bytes, inFlight string
+
+	rate      float64
+	route     func(r *http.Request) string
+	normalize func(path string) string
+}
+
+// An Option configures a Middleware.
+type Option func(*middlewareConfig)
+
+// WithRequestsBucket sets the template of the counter of requests.
+// Templates can use {route}, {method}, {status} and {status_class}. An empty template disables the metric.
+func WithRequestsBucket(template string) Option {
+	return func(c *middlewareConfig) { c.requests = template }
+}
+
+// WithLatencyBucket sets the template of the request latency timer.
+func WithLatencyBucket(template string) Option {
+	return func(c *middlewareConfig) { c.latency = template }
+}
+
+// WithStatusBucket sets the template of the counter of responses by status.
+func WithStatusBucket(template string) Option {
+	return func(c *middlewareConfig) { c.status = template }
+}
+
+// WithBytesBucket sets the template of the counter of response body bytes.
+func WithBytesBucket(template string) Option {
+	return func(c *middlewareConfig) { c.bytes = template }
+}
+
+// WithInFlightBucket sets the bucket of the gauge of requests being served. It is not a template,
+// since the route is not known yet when a request comes in. An empty bucket disables the gauge.
+func WithInFlightBucket(bucket string) Option {
+	return func(c *middlewareConfig) { c.inFlight = bucket }
+}
+
+// WithSampleRate sets the sample rate of every metric but the in-flight gauge.
+func WithSampleRate(rate float64) Option {
+	return func(c *middlewareConfig) { c.rate = rate }
+}
+
+// WithRoute sets how the route of a request is named. It is called once the request has been
+// served, and should return a low-cardinality name, made into a bucket segment with RouteSegment.
+// By default the pattern matched by http.ServeMux is used, and UnmatchedRoute for requests that
+// did not match one, so that 404s and scanners do not create a bucket for every path they try.
+func WithRoute(route func(r *http.Request) string) Option {
+	return func(c *middlewareConfig) { c.route = route }
+}
+
+// WithPathNormalizer names requests without a route pattern after their path, normalized by
+// normalize to keep IDs and other high-cardinality segments out of bucket names, NormalizePath for
+// example. Only use it when the paths reaching the handler are known, since every distinct
+// normalized path makes new buckets.
+func WithPathNormalizer(normalize func(path string) string) Option {
+	return func(c *middlewareConfig) { c.normalize = normalize }
+}
+
+// Middleware returns a function wrapping handlers to record, for every request,
+// its count, latency, status class and response size, as well as the number of requests in flight.
+func Middleware(client statsdclient.StatsClient, opts ...Option) func(http.Handler) http.Handler {
+	cfg := middlewareConfig{
+		requests: DefaultRequestsBucket,
+		latency:  DefaultLatencyBucket,
+		status:   DefaultStatusBucket,
+		bytes:    DefaultBytesBucket,
+		inFlight: DefaultInFlightBucket,
+		rate:     1,
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.route == nil {
+		cfg.route = func(r *http.Request) string {
+			switch {
+			case r.Pattern != "":
+				return r.Pattern
+			case cfg.normalize != nil:
+				return cfg.normalize(r.URL.Path)
+			}
+			return UnmatchedRoute
+		}
+	}
+
+	var inFlight int64
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.inFlight != "" {
+				client.Gauge(cfg.inFlight, int(atomic.AddInt64(&inFlight, 1)), 1)
+			}
+			rw := &responseWriter{ResponseWriter: w}
+			start := time.Now()
+			defer func() {
+				elapsed := time.Since(start)
+				if cfg.inFlight != "" {
+					client.Gauge(cfg.inFlight, int(atomic.AddInt64(&inFlight, -1)), 1)
+				}
+				err := recover()
+				if err != nil && rw.status == 0 {
+					// the server answers 500 to a panicking handler that has not written a header
+					rw.status = http.StatusInternalServerError
+				}
+				cfg.record(client, r, rw, elapsed)
+				if err != nil {
+					panic(err)
+				}
+			}()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+func (cfg *middlewareConfig) record(client statsdclient.StatsClient, r *http.Request, rw *responseWriter, elapsed time.Duration) {
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	replacer := strings.NewReplacer(
+		"{route}", RouteSegment(cfg.route(r)),
+		"{method}", methodSegment(r.Method),
+		"{status}", strconv.Itoa(status),
+		"{status_class}", StatusClass(status),
+	)
+
+	if cfg.requests != "" {
+		client.Increment(replacer.Replace(cfg.requests), 1, cfg.rate)
+	}
+	if cfg.latency != "" {
+		client.Duration(replacer.Replace(cfg.latency), elapsed, cfg.rate)
+	}
+	if cfg.status != "" {
+		client.Increment(replacer.Replace(cfg.status), 1, cfg.rate)
+	}
+	if cfg.bytes != "" {
+		client.Increment(replacer.Replace(cfg.bytes), int(rw.bytes), cfg.rate)
+	}
+}
+
+// responseWriter records the status and size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack lets handlers take over the connection, for websockets for example.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap lets http.ResponseController reach the features of the underlying ResponseWriter.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// StatusClass returns the class of an HTTP status code, "2xx" for 204.
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// methodSegment lowercases standard methods, and folds the others into "other" to keep
+// arbitrary client input out of bucket names.
+func methodSegment(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return strings.ToLower(method)
+	}
+	return "other"
+}
+
+// RouteSegment turns a route or a http.ServeMux pattern into a bucket segment:
+// "GET /users/{id}/" becomes "users.id". The root route is "root".
+func RouteSegment(route string) string {
+	// drop the method and host of ServeMux patterns
+	if i := strings.IndexByte(route, ' '); i >= 0 {
+		route = route[i+1:]
+	}
+	if i := strings.IndexByte(route, '/'); i > 0 {
+		route = route[i:]
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(route, "/") {
+		segment = strings.TrimSuffix(strings.Trim(segment, "{}"), "...")
+		if segment == "" || segment == "$" {
+			continue
+		}
+		segments = append(segments, strings.Replace(segment, ".", "_", -1))
+	}
+	if len(segments) == 0 {
+		return "root"
+	}
+	return strings.Join(segments, ".")
+}
+
+// NormalizePath replaces the segments of path that look like IDs, numbers, UUIDs or long
+// hexadecimal strings, with "{id}".
+func NormalizePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if isID(segment) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func isID(segment string) bool {
+	if segment == "" {
+		return false
+	}
+	digits := true
+	for i := 0; i < len(segment); i++ {
+		b := segment[i]
+		switch {
+		case b >= '0' && b <= '9':
+		case b >= 'a' && b <= 'f', b >= 'A' && b <= 'F', b == '-':
+			digits = false
+		default:
+			return false
+		}
+	}
+	return digits || len(segment) >= 16
+}
@@ -0,0 +1,194 @@
+//go:debug httpmuxgo121=0
+
+package httpstats
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+)
+
+func serve(t *testing.T, handler http.Handler, method, path string) *http.Response {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, err := http.NewRequest(method, server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestMiddleware(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("POST /users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	handler := Middleware(client)(mux)
+	serve(t, handler, "GET", "/users/42")
+	serve(t, handler, "POST", "/users")
+	serve(t, handler, "GET", "/missing/42")
+
+	for _, m := range []*statsdclienttest.Matcher{
+		statsdclienttest.Bucket("http.users.id.get.requests").Type(statsdclienttest.Counter).Value(statsdclienttest.Equal(1)),
+		statsdclienttest.Bucket("http.users.id.get.latency").Type(statsdclienttest.Timer),
+		statsdclienttest.Bucket("http.users.id.get.2xx").Type(statsdclienttest.Counter),
+		statsdclienttest.Bucket("http.users.id.get.response_bytes").Value(statsdclienttest.Equal(5)),
+		statsdclienttest.Bucket("http.users.post.2xx"),
+		statsdclienttest.Bucket("http.users.post.response_bytes").Value(statsdclienttest.Equal(0)),
+		// unmatched requests have no pattern
+		statsdclienttest.Bucket("http.unmatched.get.4xx"),
+		statsdclienttest.Bucket("http.in_flight").Type(statsdclienttest.Gauge).Value(statsdclienttest.Equal(1)),
+		statsdclienttest.Bucket("http.in_flight").Type(statsdclienttest.Gauge).Value(statsdclienttest.Equal(0)),
+	} {
+		statsdclienttest.AssertMatch(t, client, m)
+	}
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	handler := Middleware(client,
+		WithRequestsBucket("api.{method}.{status}"),
+		WithLatencyBucket(""),
+		WithStatusBucket(""),
+		WithBytesBucket(""),
+		WithInFlightBucket(""),
+		WithSampleRate(0.5),
+		WithPathNormalizer(func(path string) string { return "/all" }),
+	)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	}))
+	serve(t, handler, "DELETE", "/things/abc")
+
+	metrics := client.Metrics()
+	if len(metrics) != 1 {
+		t.Fatalf("expected a single metric, got %v", metrics)
+	}
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("api.delete.418").Rate(0.5))
+
+	client = statsdclienttest.NewStatsClient()
+	handler = Middleware(client, WithPathNormalizer(NormalizePath))(http.NotFoundHandler())
+	serve(t, handler, "GET", "/missing/42")
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("http.missing.id.get.4xx"))
+
+	client = statsdclienttest.NewStatsClient()
+	handler = Middleware(client, WithRoute(func(r *http.Request) string { return "custom" }))(http.NotFoundHandler())
+	serve(t, handler, "GET", "/a/b")
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("http.custom.get.requests"))
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	handler := Middleware(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("expected the panic to go through, got %v", err)
+		}
+		statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("http.*.get.5xx"))
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	handler := Middleware(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("could not flush: %s", err)
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if !rec.Flushed {
+		t.Error("expected the response to be flushed")
+	}
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	handler := Middleware(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("expected a http.Flusher")
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			t.Fatal("expected a http.Hijacker")
+		}
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			t.Fatalf("could not hijack: %s", err)
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		buf.Flush()
+	}))
+	resp := serve(t, handler, "GET", "/")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("http.unmatched.get.1xx"))
+
+	// writers that cannot be hijacked say so
+	handler = Middleware(client)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			t.Error("expected hijacking a recorder to fail")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestRouteSegment(t *testing.T) {
+	tests := map[string]string{
+		"/":                                "root",
+		"GET /{$}":                         "root",
+		"GET /users/{id}/":                 "users.id",
+		"POST example.com/files/{path...}": "files.path",
+		"/v1.2/items":                      "v1_2.items",
+	}
+	for route, expected := range tests {
+		if got := RouteSegment(route); got != expected {
+			t.Errorf("RouteSegment(%q) = %q, expected %q", route, got, expected)
+		}
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	tests := map[string]string{
+		"/users/42": "/users/{id}",
+		"/v1/users": "/v1/users",
+		"/orders/3f2b1c9e-8d4a-4e2f-9b1a-2c3d4e5f6a7b": "/orders/{id}",
+		"/commits/deadbeefdeadbeef/files":              "/commits/{id}/files",
+		"/beef":                                        "/beef",
+	}
+	for path, expected := range tests {
+		if got := NormalizePath(path); got != expected {
+			t.Errorf("NormalizePath(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	for status, expected := range map[int]string{204: "2xx", 301: "3xx", 503: "5xx", 42: "unknown"} {
+		if got := StatusClass(status); !strings.EqualFold(got, expected) {
+			t.Errorf("StatusClass(%d) = %q, expected %q", status, got, expected)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package httpstats
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+)
+
+// Default bucket prefix of Transport
+const DefaultTransportPrefix = "http.client"
+
+// Error classes of failed requests, the last segment of their "errors" bucket
+const (
+	ErrorDNS      = "dns"
+	ErrorConnect  = "connect"
+	ErrorTLS      = "tls"
+	ErrorTimeout  = "timeout"
+	ErrorCanceled = "canceled"
+	ErrorOther    = "other"
+)
+
+// A Transport is an http.RoundTripper recording metrics of outbound requests per host:
+// "requests", "latency" until the response headers arrive, "errors.<class>" for failed requests
+// and "<status_class>" for responses, under the bucket "<prefix>.<host>".
+// When the client supports tags, see statsdclient.Tagger, the host is sent as a "host" tag instead of a bucket segment.
+//
+// With tracing on, the timers "dns", "connect", "tls" and "ttfb" (time to first byte) record the phases of requests.
+type Transport struct {
+	base   http.RoundTripper
+	client statsdclient.StatsClient
+
+	prefix      string
+	rate        float64
+	trace       bool
+	hostSegment bool
+}
+
+// A TransportOption configures a Transport.
+type TransportOption func(*Transport)
+
+// WithTransportPrefix sets the prefix of the buckets of a Transport.
+func WithTransportPrefix(prefix string) TransportOption {
+	return func(t *Transport) { t.prefix = strings.TrimRight(prefix, ".") }
+}
+
+// WithTransportSampleRate sets the sample rate of every metric of a Transport.
+func WithTransportSampleRate(rate float64) TransportOption {
+	return func(t *Transport) { t.rate = rate }
+}
+
+// WithTrace turns on the httptrace phase timings.
+func WithTrace() TransportOption {
+	return func(t *Transport) { t.trace = true }
+}
+
+// WithHostSegment puts the host in bucket names even when the client supports tags.
+func WithHostSegment() TransportOption {
+	return func(t *Transport) { t.hostSegment = true }
+}
+
+// NewTransport returns a Transport making requests with base, http.DefaultTransport when nil,
+// and recording their metrics with client.
+func NewTransport(client statsdclient.StatsClient, base http.RoundTripper, opts ...TransportOption) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &Transport{
+		base:   base,
+		client: client,
+		prefix: DefaultTransportPrefix,
+		rate:   1,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// RoundTrip makes the request with the base transport, recording its metrics.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client, prefix := t.clientFor(req.URL.Host)
+	if t.trace {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), t.clientTrace(client, prefix)))
+	}
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	client.Increment(prefix+"requests", 1, t.rate)
+	client.Duration(prefix+"latency", time.Since(start), t.rate)
+	if err != nil {
+		class := ErrorClass(err)
+		if ctxErr := req.Context().Err(); class == ErrorOther && ctxErr != nil {
+			// the transport may report a canceled request without saying why
+			class = ErrorClass(ctxErr)
+		}
+		client.Increment(prefix+"errors."+class, 1, t.rate)
+		return nil, err
+	}
+	client.Increment(prefix+StatusClass(resp.StatusCode), 1, t.rate)
+	return resp, nil
+}
+
+// clientFor returns the client and bucket prefix of the requests to host.
+func (t *Transport) clientFor(host string) (statsdclient.StatsClient, string) {
+	if host == "" {
+		host = "unknown"
+	}
+	if !t.hostSegment {
+		if client, ok := statsdclient.WithTags(t.client, "host:"+host); ok {
+			return client, t.prefix + "."
+		}
+	}
+	return t.client, t.prefix + "." + hostSegment(host) + "."
+}
+
+// hostSegment turns "api.example.com:8080" into the single bucket segment "api_example_com_8080".
+func hostSegment(host string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "[", "", "]", "").Replace(host)
+}
+
+// clientTrace returns the hooks recording the phases of a request.
+func (t *Transport) clientTrace(client statsdclient.StatsClient, prefix string) *httptrace.ClientTrace {
+	var (
+		m                         sync.Mutex
+		dnsStart, tlsStart, start time.Time
+		connectStarts             = map[string]time.Time{}
+	)
+	start = time.Now()
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			m.Lock()
+			defer m.Unlock()
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			m.Lock()
+			defer m.Unlock()
+			if info.Err == nil && !dnsStart.IsZero() {
+				client.Duration(prefix+"dns", time.Since(dnsStart), t.rate)
+			}
+		},
+		// several addresses may be dialed in parallel
+		ConnectStart: func(network, addr string) {
+			m.Lock()
+			defer m.Unlock()
+			connectStarts[network+addr] = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			m.Lock()
+			defer m.Unlock()
+			if connectStart, ok := connectStarts[network+addr]; ok && err == nil {
+				client.Duration(prefix+"connect", time.Since(connectStart), t.rate)
+			}
+		},
+		TLSHandshakeStart: func() {
+			m.Lock()
+			defer m.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			m.Lock()
+			defer m.Unlock()
+			if err == nil && !tlsStart.IsZero() {
+				client.Duration(prefix+"tls", time.Since(tlsStart), t.rate)
+			}
+		},
+		GotFirstResponseByte: func() {
+			client.Duration(prefix+"ttfb", time.Since(start), t.rate)
+		},
+	}
+}
+
+// ErrorClass returns the class of an error returned by a RoundTripper: ErrorDNS, ErrorConnect,
+// ErrorTLS, ErrorTimeout, ErrorCanceled or ErrorOther.
+func ErrorClass(err error) string {
+	var (
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		opErr        *net.OpError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorTimeout
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorConnect
+	}
+	return ErrorOther
+}
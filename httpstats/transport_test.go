@@ -0,0 +1,132 @@
+package httpstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+)
+
+func get(t *testing.T, client *http.Client, url string) error {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestTransportTags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	host := server.Listener.Addr().String()
+
+	stats := statsdclient.NewMockClient()
+	client := &http.Client{Transport: NewTransport(stats, nil)}
+	get(t, client, server.URL)
+	get(t, client, server.URL+"/missing")
+
+	hostTag := statsdclienttest.Has("host", host)
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.requests").Tags(hostTag))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.latency").Type(statsdclienttest.Timer).Tags(hostTag))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.2xx").Tags(hostTag))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.4xx").Tags(hostTag))
+}
+
+func TestTransportSegments(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	stats := statsdclienttest.NewStatsClient()
+	client := &http.Client{Transport: NewTransport(stats, nil, WithTransportPrefix("deps."), WithTransportSampleRate(0.5))}
+	get(t, client, server.URL)
+
+	prefix := "deps.127_0_0_1_" + port + "."
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket(prefix+"requests").Rate(0.5))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket(prefix+"2xx").Rate(0.5))
+
+	// clients supporting tags can be made to use segments too
+	mock := statsdclient.NewMockClient()
+	client = &http.Client{Transport: NewTransport(mock, nil, WithHostSegment())}
+	get(t, client, server.URL)
+	statsdclienttest.AssertMatch(t, mock, statsdclienttest.Bucket("http.client.127_0_0_1_"+port+".requests"))
+}
+
+func TestTransportErrors(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slow.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedURL := "http://" + closed.Addr().String()
+	closed.Close()
+
+	stats := statsdclienttest.NewStatsClient()
+	client := &http.Client{Transport: NewTransport(stats, nil)}
+	for _, url := range []string{secure.URL, closedURL} {
+		if err := get(t, client, url); err == nil {
+			t.Errorf("expected %s to fail", url)
+		}
+	}
+	client.Timeout = 50 * time.Millisecond
+	if err := get(t, client, slow.URL); err == nil {
+		t.Error("expected the request to time out")
+	}
+
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.*.errors.timeout"))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.*.errors.tls"))
+	statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.*.errors.connect"))
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}, ErrorDNS},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorConnect},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), ErrorTimeout},
+		{context.Canceled, ErrorCanceled},
+		{errors.New("EOF"), ErrorOther},
+	}
+	for _, test := range tests {
+		if got := ErrorClass(test.err); got != test.expected {
+			t.Errorf("ErrorClass(%v) = %q, expected %q", test.err, got, test.expected)
+		}
+	}
+}
+
+func TestTransportTrace(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	stats := statsdclienttest.NewStatsClient()
+	client := &http.Client{Transport: NewTransport(stats, server.Client().Transport, WithTrace())}
+	if err := get(t, client, server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, phase := range []string{"connect", "tls", "ttfb"} {
+		statsdclienttest.AssertMatch(t, stats, statsdclienttest.Bucket("http.client.*."+phase).Type(statsdclienttest.Timer))
+	}
+	// the server is dialed by IP, without a lookup
+	statsdclienttest.AssertNoMatch(t, stats, statsdclienttest.Bucket("http.client.*.dns"))
+}
@@ -0,0 +1,45 @@
+// Package ticker runs the periodic collections of the collectors of this module.
+package ticker
+
+import (
+	"sync"
+	"time"
+)
+
+// A Ticker calls a function every interval from its own goroutine, until it is stopped.
+type Ticker struct {
+	stop chan struct{}
+	once sync.Once
+	done chan struct{}
+}
+
+// Start calls f every interval until Stop is called. The first call happens after one interval.
+func Start(interval time.Duration, f func()) *Ticker {
+	t := &Ticker{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go t.run(interval, f)
+	return t
+}
+
+func (t *Ticker) run(interval time.Duration, f func()) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the calls to f, and waits for the call in progress, if any, to return.
+// It can be called several times.
+func (t *Ticker) Stop() {
+	t.once.Do(func() { close(t.stop) })
+	<-t.done
+}
@@ -0,0 +1,27 @@
+package ticker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTicker(t *testing.T) {
+	var calls atomic.Int32
+	ticker := Start(time.Millisecond, func() { calls.Add(1) })
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	ticker.Stop()
+	ticker.Stop()
+
+	stopped := calls.Load()
+	if stopped < 3 {
+		t.Fatalf("expected at least 3 calls, got %d", stopped)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := calls.Load(); got != stopped {
+		t.Errorf("expected no call after Stop, got %d more", got-stopped)
+	}
+}
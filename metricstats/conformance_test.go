@@ -0,0 +1,266 @@
+package metricstats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+var _ Provider = (*ClientProvider)(nil)
+
+// A backend is a way of sending metrics the conformance tests run against.
+type backend struct {
+	name string
+	new  func() (*ClientProvider, statsdclienttest.Recorder)
+	// series names the metric of name with labels as it is recorded
+	series func(name string, labels ...string) string
+}
+
+// seriesOf names a recorded metric after its bucket and sorted tags.
+func seriesOf(m statsdproto.Metric) string {
+	tags := append([]string(nil), m.Tags...)
+	sort.Strings(tags)
+	return strings.Join(append([]string{m.Bucket}, tags...), " ")
+}
+
+var backends = []backend{
+	{
+		name: "tags",
+		new: func() (*ClientProvider, statsdclienttest.Recorder) {
+			client := statsdclient.NewMockClient()
+			return NewProvider(client), client
+		},
+		series: func(name string, labels ...string) string {
+			var tags []string
+			for i := 0; i < len(labels); i += 2 {
+				tags = append(tags, labels[i]+":"+labels[i+1])
+			}
+			sort.Strings(tags)
+			return strings.Join(append([]string{name}, tags...), " ")
+		},
+	},
+	{
+		name: "segments",
+		new: func() (*ClientProvider, statsdclienttest.Recorder) {
+			client := statsdclienttest.NewStatsClient()
+			return NewProvider(client), client
+		},
+		series: func(name string, labels ...string) string {
+			for i := 1; i < len(labels); i += 2 {
+				name += "." + labels[i]
+			}
+			return name
+		},
+	},
+}
+
+// values returns the values recorded for every series, of type typ.
+func values(rec statsdclienttest.Recorder, typ statsdproto.Type) map[string][]float64 {
+	values := map[string][]float64{}
+	for _, m := range rec.Metrics() {
+		if m.Type == typ {
+			values[seriesOf(m)] = append(values[seriesOf(m)], m.Float())
+		}
+	}
+	return values
+}
+
+func sum(values []float64) float64 {
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
+func TestConformance(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("counter", func(t *testing.T) { testCounter(t, b) })
+			t.Run("gauge", func(t *testing.T) { testGauge(t, b) })
+			t.Run("histogram", func(t *testing.T) { testHistogram(t, b) })
+			t.Run("labels", func(t *testing.T) { testLabels(t, b) })
+			t.Run("concurrency", func(t *testing.T) { testConcurrency(t, b) })
+		})
+	}
+}
+
+func testCounter(t *testing.T, b backend) {
+	p, rec := b.new()
+	c := p.NewCounter("requests")
+	c.Add(1)
+	c.Add(2)
+	// fractions add up to whole increments, decrements are ignored
+	c.Add(0.5)
+	c.Add(0.75)
+	c.Add(-10)
+
+	counts := values(rec, statsdproto.Counter)
+	if got := sum(counts[b.series("requests")]); got != 4 {
+		t.Errorf("got a total of %g, expected 4", got)
+	}
+}
+
+func testGauge(t *testing.T, b backend) {
+	p, rec := b.new()
+	g := p.NewGauge("connections")
+	g.Set(10)
+	g.Add(2.4)
+	g.Add(-5)
+	// a negative value is sent after a reset to 0, not as a decrement
+	g.Set(-3)
+	// gauges with the same labels share their value
+	g.With("a", "1", "b", "2").Set(3)
+	g.With("a", "1").With("b", "2").Add(1)
+
+	gauges := values(rec, statsdproto.Gauge)
+	expected := []float64{10, 12, 7, 0, -3}
+	got := gauges[b.series("connections")]
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("got %v, expected %v", got, expected)
+		}
+	}
+	labelled := gauges[b.series("connections", "a", "1", "b", "2")]
+	if len(labelled) != 2 || labelled[1] != 4 {
+		t.Errorf("expected the labelled gauge to go from 3 to 4, got %v", labelled)
+	}
+}
+
+func testHistogram(t *testing.T, b backend) {
+	p, rec := b.new()
+	h := p.NewHistogram("latency", 50)
+	h.Observe(12.5)
+	h.With("route", "home").Observe(3)
+
+	timers := values(rec, statsdproto.Timer)
+	if got := timers[b.series("latency")]; len(got) != 1 || got[0] != 12.5 {
+		t.Errorf("expected an observation of 12.5ms, got %v", got)
+	}
+	if got := timers[b.series("latency", "route", "home")]; len(got) != 1 || got[0] != 3 {
+		t.Errorf("expected an observation of 3ms, got %v", got)
+	}
+}
+
+func testLabels(t *testing.T, b backend) {
+	p, rec := b.new()
+	c := p.NewCounter("requests")
+	get := c.With("method", "GET")
+	get.With("code", "200").Add(1)
+	get.Add(1)
+	c.Add(1)
+	// a missing value
+	c.With("method").Add(1)
+
+	counts := values(rec, statsdproto.Counter)
+	for _, series := range []string{
+		b.series("requests", "method", "GET", "code", "200"),
+		b.series("requests", "method", "GET"),
+		b.series("requests"),
+		b.series("requests", "method", missingLabelValue),
+	} {
+		if got := sum(counts[series]); got != 1 {
+			t.Errorf("%s: got %g, expected 1 (all: %v)", series, got, counts)
+		}
+	}
+}
+
+func testConcurrency(t *testing.T, b backend) {
+	p, rec := b.new()
+	c := p.NewCounter("requests")
+	g := p.NewGauge("inflight")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.With("worker", "w").Add(0.5)
+				g.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := sum(values(rec, statsdproto.Counter)[b.series("requests", "worker", "w")]); got != 400 {
+		t.Errorf("got a total of %g, expected 400", got)
+	}
+	gauges := values(rec, statsdproto.Gauge)[b.series("inflight")]
+	max := 0.0
+	for _, v := range gauges {
+		if v > max {
+			max = v
+		}
+	}
+	if max != 800 {
+		t.Errorf("expected the gauge to reach 800, got %g", max)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	client := statsdclient.NewMockClient()
+	p := NewProvider(client, WithPrefix("app."), WithLabelSegments(), WithSampleRate(0.999999))
+	p.NewCounter("requests").With("method", "G.E.T").Add(1)
+	p.Stop()
+
+	stat, _ := client.NextStat()
+	if !strings.HasPrefix(stat, "app.requests.G_E_T:1|c|@0.999999") {
+		t.Errorf("unexpected stat %q", stat)
+	}
+}
+
+func TestStateKeys(t *testing.T) {
+	client := statsdclient.NewMockClient()
+	p := NewProvider(client)
+	// the order of tags does not matter
+	g := p.NewGauge("connections")
+	g.With("a", "1", "b", "2").Set(3)
+	g.With("b", "2", "a", "1").Add(1)
+	got := values(client, statsdproto.Gauge)["connections a:1 b:2"]
+	if len(got) != 2 || got[1] != 4 {
+		t.Errorf("expected the gauge to go from 3 to 4, got %v", got)
+	}
+
+	// whole increments leave nothing behind
+	c := p.NewCounter("requests")
+	c.With("a", "1").Add(0.5)
+	c.With("a", "2").Add(0.5)
+	c.With("a", "1").Add(0.5)
+	if len(p.remainders) != 1 {
+		t.Errorf("expected 1 remainder, got %v", p.remainders)
+	}
+}
+
+func TestStateExpiry(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	clock := time.Unix(0, 0)
+	now = func() time.Time { return clock }
+
+	client := statsdclient.NewMockClient()
+	p := NewProvider(client, WithStateExpiry(time.Minute))
+	g := p.NewGauge("connections")
+	g.With("id", "old").Set(5)
+	p.NewCounter("requests").With("id", "old").Add(0.5)
+	clock = clock.Add(30 * time.Second)
+	g.With("id", "new").Set(1)
+	clock = clock.Add(30 * time.Second)
+	g.With("id", "new").Add(1)
+
+	if len(p.gauges) != 1 || len(p.remainders) != 0 {
+		t.Fatalf("expected only the new gauge to be kept, got %v and %v", p.gauges, p.remainders)
+	}
+	g.With("id", "old").Add(1)
+	if got := values(client, statsdproto.Gauge)["connections id:old"]; len(got) != 2 || got[1] != 1 {
+		t.Errorf("expected the expired gauge to start again from zero, got %v", got)
+	}
+}
@@ -0,0 +1,271 @@
+// Package metricstats adapts a statsd client to Counter, Gauge and Histogram interfaces with label
+// values, the same as the ones of go-kit's metrics package, so that code written against them can
+// report to statsd without further dependencies:
+//
+//	provider := metricstats.NewProvider(client)
+//	requests := provider.NewCounter("http.requests")
+//	requests.With("method", "GET", "code", "200").Add(1)
+//
+// Labels are sent as DogStatsD tags, "method:GET", when the client supports them, see
+// statsdclient.Tagger, and appended as bucket segments otherwise: "http.requests.GET.200".
+package metricstats
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+)
+
+// A Counter is a monotonically increasing value.
+type Counter interface {
+	With(labelValues ...string) Counter
+	Add(delta float64)
+}
+
+// A Gauge is a value that goes up and down.
+type Gauge interface {
+	With(labelValues ...string) Gauge
+	Set(value float64)
+	Add(delta float64)
+}
+
+// A Histogram is a distribution of observed values.
+type Histogram interface {
+	With(labelValues ...string) Histogram
+	Observe(value float64)
+}
+
+// A Provider creates metrics.
+type Provider interface {
+	NewCounter(name string) Counter
+	NewGauge(name string) Gauge
+	NewHistogram(name string, buckets int) Histogram
+	Stop()
+}
+
+// The value of a label without one, when With is given an odd number of label values
+const missingLabelValue = "unknown"
+
+// An Option configures a ClientProvider.
+type Option func(*ClientProvider)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(p *ClientProvider) { p.prefix = strings.TrimRight(prefix, ".") + "." }
+}
+
+// WithSampleRate sets the sample rate of counters and histograms.
+func WithSampleRate(rate float64) Option {
+	return func(p *ClientProvider) { p.rate = rate }
+}
+
+// WithLabelSegments appends label values to bucket names even when the client supports tags.
+func WithLabelSegments() Option {
+	return func(p *ClientProvider) { p.segments = true }
+}
+
+// WithStateExpiry forgets the value of gauges and the fractions counters could not send yet
+// once they have not been updated for d, bounding the memory of short-lived label values. Add
+// on a gauge that expired starts again from zero. By default, gauges are kept as long as the
+// provider and fractions until they add up to a whole increment.
+func WithStateExpiry(d time.Duration) Option {
+	return func(p *ClientProvider) { p.expiry = d }
+}
+
+// A ClientProvider is a Provider creating metrics that report through a statsd client.
+type ClientProvider struct {
+	client   statsdclient.StatsClient
+	prefix   string
+	rate     float64
+	segments bool
+	expiry   time.Duration
+
+	// The values of gauges, to apply Add to, and the fractions counters could not send yet,
+	// by series, since metrics returned by With do not share state otherwise
+	m          sync.Mutex
+	gauges     map[string]state
+	remainders map[string]state
+	swept      time.Time
+}
+
+// state is a value kept between updates of a series.
+type state struct {
+	value   float64
+	updated time.Time
+}
+
+// now is replaced by tests.
+var now = time.Now
+
+// update sets the value of key in states and forgets the series not updated for the expiry,
+// at most once per expiry.
+func (p *ClientProvider) update(states map[string]state, key string, value float64) {
+	t := now()
+	states[key] = state{value, t}
+	if p.expiry <= 0 || t.Sub(p.swept) < p.expiry {
+		return
+	}
+	p.swept = t
+	for _, states := range []map[string]state{p.gauges, p.remainders} {
+		for k, s := range states {
+			if t.Sub(s.updated) >= p.expiry {
+				delete(states, k)
+			}
+		}
+	}
+}
+
+// NewProvider returns a provider of metrics reporting through client.
+func NewProvider(client statsdclient.StatsClient, opts ...Option) *ClientProvider {
+	p := &ClientProvider{
+		client:     client,
+		rate:       1,
+		gauges:     map[string]state{},
+		remainders: map[string]state{},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.swept = now()
+	return p
+}
+
+// NewCounter returns a counter sent to the bucket name. Fractional increments are added up
+// until they make a whole one, since statsd counters are integers.
+func (p *ClientProvider) NewCounter(name string) Counter {
+	return &counter{metric{p: p, name: name}}
+}
+
+// NewGauge returns a gauge sent to the bucket name, rounded to an integer.
+func (p *ClientProvider) NewGauge(name string) Gauge {
+	return &gauge{metric{p: p, name: name}}
+}
+
+// NewHistogram returns a histogram sent to the bucket name as a timer, observations being
+// milliseconds. The statsd server computes the distribution, so buckets is ignored.
+func (p *ClientProvider) NewHistogram(name string, buckets int) Histogram {
+	return &histogram{metric{p: p, name: name}}
+}
+
+// Stop does nothing, the client is closed by its owner.
+func (p *ClientProvider) Stop() {}
+
+// metric is what counters, gauges and histograms have in common: a name and label values.
+type metric struct {
+	p      *ClientProvider
+	name   string
+	labels []string
+}
+
+func (m metric) with(labelValues []string) metric {
+	if len(labelValues)%2 == 1 {
+		labelValues = append(labelValues, missingLabelValue)
+	}
+	m.labels = append(append([]string(nil), m.labels...), labelValues...)
+	return m
+}
+
+// target returns the client and bucket to send the metric to, and the key of the series they
+// make. Tags are sorted in the key, since their order does not matter, unlike that of
+// segments.
+func (m metric) target() (client statsdclient.StatsClient, bucket, key string) {
+	bucket = m.p.prefix + m.name
+	if len(m.labels) == 0 {
+		return m.p.client, bucket, bucket
+	}
+
+	if !m.p.segments {
+		tags := make([]string, 0, len(m.labels)/2)
+		for i := 0; i < len(m.labels); i += 2 {
+			tags = append(tags, m.labels[i]+":"+m.labels[i+1])
+		}
+		if client, ok := statsdclient.WithTags(m.p.client, tags...); ok {
+			sort.Strings(tags)
+			return client, bucket, bucket + "\x00" + strings.Join(tags, "\x00")
+		}
+	}
+	for i := 1; i < len(m.labels); i += 2 {
+		bucket += "." + statsdclient.SanitizeSegment(m.labels[i])
+	}
+	return m.p.client, bucket, bucket
+}
+
+type counter struct {
+	metric
+}
+
+func (c *counter) With(labelValues ...string) Counter {
+	return &counter{c.with(labelValues)}
+}
+
+func (c *counter) Add(delta float64) {
+	if delta <= 0 {
+		return
+	}
+	client, bucket, key := c.target()
+	c.p.m.Lock()
+	total := c.p.remainders[key].value + delta
+	whole := math.Floor(total)
+	if total == whole {
+		delete(c.p.remainders, key)
+	} else {
+		c.p.update(c.p.remainders, key, total-whole)
+	}
+	c.p.m.Unlock()
+
+	if whole > 0 {
+		client.Increment(bucket, int(whole), c.p.rate)
+	}
+}
+
+type gauge struct {
+	metric
+}
+
+func (g *gauge) With(labelValues ...string) Gauge {
+	return &gauge{g.with(labelValues)}
+}
+
+func (g *gauge) Set(value float64) {
+	client, bucket, key := g.target()
+	g.p.m.Lock()
+	g.p.update(g.p.gauges, key, value)
+	g.p.m.Unlock()
+	g.send(client, bucket, value)
+}
+
+func (g *gauge) Add(delta float64) {
+	client, bucket, key := g.target()
+	g.p.m.Lock()
+	value := g.p.gauges[key].value + delta
+	g.p.update(g.p.gauges, key, value)
+	g.p.m.Unlock()
+	g.send(client, bucket, value)
+}
+
+// send sends value as the absolute value of the gauge. statsd reads "-N|g" as a change of the
+// previous value, so a negative value is sent as a change of 0.
+func (g *gauge) send(client statsdclient.StatsClient, bucket string, value float64) {
+	n := int(math.Round(value))
+	if n < 0 {
+		client.Gauge(bucket, 0, 1)
+	}
+	client.Gauge(bucket, n, 1)
+}
+
+type histogram struct {
+	metric
+}
+
+func (h *histogram) With(labelValues ...string) Histogram {
+	return &histogram{h.with(labelValues)}
+}
+
+func (h *histogram) Observe(value float64) {
+	client, bucket, _ := h.target()
+	client.Duration(bucket, time.Duration(value*float64(time.Millisecond)), h.p.rate)
+}
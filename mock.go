@@ -2,20 +2,95 @@ package statsdclient
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
-	"strings"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
 )
 
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Stat is a stat recorded by a MockClient.
+type Stat struct {
+	// The bucket, including the client's prefix
+	Bucket string
+
+	// The value as sent, for example "1", "-4" or "+10" for gauge deltas
+	Value string
+
+	// The statsd type: "c", "g", "ms" or "s"
+	Type string
+
+	// The sample rate, 1 when none was sent
+	Rate float64
+
+	Tags []string
+
+	// The line as it was sent
+	line string
+}
+
+// parseStat splits a line sent by a Client into its parts.
+func parseStat(line string) Stat {
+	m, err := statsdproto.ParseLine(line)
+	if err != nil {
+		// a line the client should never have sent, keep it for NextStat
+		return Stat{line: line}
+	}
+	return Stat{
+		Bucket: m.Bucket,
+		Value:  m.Value,
+		Type:   string(m.Type),
+		Rate:   m.Rate,
+		Tags:   m.Tags,
+		line:   line,
+	}
+}
+
+// Metric returns the stat as a statsdproto.Metric.
+func (s Stat) Metric() statsdproto.Metric {
+	return statsdproto.Metric{
+		Bucket: s.Bucket,
+		Value:  s.Value,
+		Type:   statsdproto.Type(s.Type),
+		Rate:   s.Rate,
+		Tags:   s.Tags,
+	}
+}
+
+// A MockClient is a Client that records every stat as soon as it is sent, instead of sending it to a server.
+// It is safe to use from several goroutines.
 type MockClient struct {
 	Client
-	buffer *bytes.Buffer
+
+	rm    sync.Mutex
+	stats []Stat
+	// How many stats NextStat has returned
+	next int
+	// Closed and replaced every time a stat is recorded
+	recorded chan struct{}
 }
 
 func (c *MockClient) Close() error {
 	return nil
 }
 
+func (c *MockClient) record(line string) {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	c.stats = append(c.stats, parseStat(line))
+	close(c.recorded)
+	c.recorded = make(chan struct{})
+}
+
 // NextStat returns a string representation of the stat:
 // 		Increment "statname:1|c"
 // 		Decrement "statname:-1|c"
@@ -24,15 +99,92 @@ func (c *MockClient) Close() error {
 // No newline delimiter is included in the result.
 // If no more stats are available, an empty string is returned accompanied by a non-nil error.
 func (c *MockClient) NextStat() (string, error) {
-	stat, _ := c.buffer.ReadString(0x0A) // newline character
-	stat = strings.TrimSpace(stat)
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	if c.next == len(c.stats) {
+		return "", errors.New("End of stats")
+	}
+	c.next++
+	return c.stats[c.next-1].line, nil
+}
+
+// Stats returns every stat recorded so far, oldest first.
+func (c *MockClient) Stats() []Stat {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	return append([]Stat(nil), c.stats...)
+}
+
+// Metrics returns every stat recorded so far as a statsdproto.Metric, oldest first.
+func (c *MockClient) Metrics() []statsdproto.Metric {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	metrics := make([]statsdproto.Metric, len(c.stats))
+	for i, stat := range c.stats {
+		metrics[i] = stat.Metric()
+	}
+	return metrics
+}
 
-	var err error
-	if stat == "" {
-		err = errors.New("End of stats")
+// Find returns the stats recorded for bucket, oldest first.
+func (c *MockClient) Find(bucket string) []Stat {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	var found []Stat
+	for _, stat := range c.stats {
+		if stat.Bucket == bucket {
+			found = append(found, stat)
+		}
 	}
+	return found
+}
+
+// Reset forgets every stat recorded so far.
+func (c *MockClient) Reset() {
+	c.rm.Lock()
+	defer c.rm.Unlock()
+	c.stats = nil
+	c.next = 0
+}
+
+// wait calls done every time a stat is recorded, until it returns true or timeout passes.
+func (c *MockClient) wait(timeout time.Duration, done func() bool) bool {
+	deadline := time.After(timeout)
+	for {
+		c.rm.Lock()
+		ok := done()
+		recorded := c.recorded
+		c.rm.Unlock()
+		if ok {
+			return true
+		}
+
+		select {
+		case <-recorded:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// WaitFor waits up to timeout for a stat to be recorded for bucket, and returns the first one.
+func (c *MockClient) WaitFor(bucket string, timeout time.Duration) (Stat, bool) {
+	var found Stat
+	ok := c.wait(timeout, func() bool {
+		for _, stat := range c.stats {
+			if stat.Bucket == bucket {
+				found = stat
+				return true
+			}
+		}
+		return false
+	})
+	return found, ok
+}
 
-	return stat, err
+// WaitN waits up to timeout for at least n stats to be recorded.
+func (c *MockClient) WaitN(n int, timeout time.Duration) bool {
+	return c.wait(timeout, func() bool { return len(c.stats) >= n })
 }
 
 // Used for mocking the StatsClient for testing purposes
@@ -52,9 +204,10 @@ func NewMockClient() *MockClient {
 
 // Create a mock of the StatsClient with a configurable buffer size
 func NewMockClientSize(size int) *MockClient {
-	buffer := new(bytes.Buffer)
-	return &MockClient{
-		Client: Client{buf: bufio.NewWriterSize(buffer, size)},
-		buffer: buffer,
+	c := &MockClient{
+		Client:   Client{conn: nopCloser{io.Discard}, buf: bufio.NewWriterSize(io.Discard, size)},
+		recorded: make(chan struct{}),
 	}
+	c.Client.record = c.record
+	return c
 }
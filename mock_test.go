@@ -0,0 +1,78 @@
+package statsdclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMockClientStats(t *testing.T) {
+	c := NewMockClient()
+	c.SetPrefix("app")
+	c.SetTags("env:prod")
+	c.Increment("incr", 1, 1)
+	c.IncrementGauge("gauge", 10, 1)
+	c.Increment("incr", 2, 1)
+
+	// no Flush needed
+	expected := []Stat{
+		{Bucket: "app.incr", Value: "1", Type: "c", Rate: 1, Tags: []string{"env:prod"}, line: "app.incr:1|c|#env:prod"},
+		{Bucket: "app.gauge", Value: "+10", Type: "g", Rate: 1, Tags: []string{"env:prod"}, line: "app.gauge:+10|g|#env:prod"},
+		{Bucket: "app.incr", Value: "2", Type: "c", Rate: 1, Tags: []string{"env:prod"}, line: "app.incr:2|c|#env:prod"},
+	}
+	assert.Equal(t, expected, c.Stats())
+	assert.Equal(t, []Stat{expected[0], expected[2]}, c.Find("app.incr"))
+	assert.Equal(t, 0, len(c.Find("incr")))
+
+	stat, _ := c.NextStat()
+	assert.Equal(t, "app.incr:1|c|#env:prod", stat)
+
+	c.Reset()
+	assert.Equal(t, 0, len(c.Stats()))
+	_, err := c.NextStat()
+	assert.NotEqual(t, err, nil)
+}
+
+func TestMockClientRate(t *testing.T) {
+	c := NewMockClient()
+	c.Increment("incr", 1, 0.999999)
+	assert.Equal(t, 0.999999, c.Stats()[0].Rate)
+}
+
+func TestMockClientConcurrent(t *testing.T) {
+	c := NewMockClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Increment("incr", 1, 1)
+				c.Stats()
+				c.NextStat()
+			}
+		}()
+	}
+
+	assert.T(t, c.WaitN(1000, time.Second), "not every stat was recorded")
+	wg.Wait()
+	assert.Equal(t, 1000, len(c.Find("incr")))
+}
+
+func TestMockClientWaitFor(t *testing.T) {
+	c := NewMockClient()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Gauge("other", 1, 1)
+		c.Gauge("gauge", 7, 1)
+	}()
+
+	stat, ok := c.WaitFor("gauge", time.Second)
+	assert.T(t, ok, "gauge was not recorded")
+	assert.Equal(t, "7", stat.Value)
+
+	_, ok = c.WaitFor("missing", 10*time.Millisecond)
+	assert.T(t, !ok, "missing should not have been recorded")
+}
@@ -0,0 +1,390 @@
+package statsdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Destination is one of the clients a MultiClient sends to.
+type Destination struct {
+	Client StatsClient
+
+	// Prepended to every stat sent to this destination, on top of the client's own prefix.
+	// Like SetPrefix, a single "." is added at the end.
+	Prefix string
+
+	// Multiplies the sample rate of every stat sent to this destination. Zero means 1.
+	Rate float64
+
+	// How many stats can wait to be sent to this destination. Once it is full, stats for
+	// this destination are dropped instead of blocking the caller. Zero means DefaultQueueSize.
+	QueueSize int
+
+	// Called with the errors returned by Client as they happen, from the goroutine sending to
+	// this destination. They are returned by Flush, Close and Shutdown too.
+	OnError func(error)
+}
+
+// DefaultQueueSize is the QueueSize of destinations that do not set one.
+const DefaultQueueSize = 1024
+
+// ErrQueueFull is returned for a destination whose queue is full, the stat is dropped for it.
+var ErrQueueFull = errors.New("Destination queue is full")
+
+// A MultiClient sends every stat to several destinations, for example to two statsd
+// servers while migrating from one to the other.
+// Every destination is sent to from a goroutine of its own, so a slow destination neither
+// delays the others nor blocks the caller: once its queue is full, its stats are dropped.
+// Errors returned by a destination's client are kept until the next Flush, Close or Shutdown,
+// which return them joined with their own, and passed to its OnError.
+type MultiClient struct {
+	// Held for reading while queueing, and for writing while closing the queues
+	m      sync.RWMutex
+	closed bool
+	dests  []*destination
+}
+
+type destination struct {
+	Destination
+	queue   chan func()
+	done    chan struct{}
+	dropped int64
+
+	// The errors of the stats sent since they were last returned, and how many more there were
+	em     sync.Mutex
+	errs   []error
+	excess int
+}
+
+// How many errors a destination keeps until they are returned, the others are only counted
+const maxDestinationErrors = 10
+
+// run sends the queued stats until the queue is closed.
+func (d *destination) run() {
+	defer close(d.done)
+	for send := range d.queue {
+		send()
+	}
+}
+
+// report keeps err and passes it to OnError, if set.
+func (d *destination) report(err error) {
+	if err == nil {
+		return
+	}
+	d.em.Lock()
+	if len(d.errs) < maxDestinationErrors {
+		d.errs = append(d.errs, err)
+	} else {
+		d.excess++
+	}
+	d.em.Unlock()
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+// takeErrors returns the errors kept so far and forgets them.
+func (d *destination) takeErrors() []error {
+	d.em.Lock()
+	defer d.em.Unlock()
+	errs := d.errs
+	if d.excess > 0 {
+		errs = append(errs, fmt.Errorf("%d more errors", d.excess))
+	}
+	d.errs, d.excess = nil, 0
+	return errs
+}
+
+// NewMultiClient returns a client sending to all of dests.
+func NewMultiClient(dests ...Destination) *MultiClient {
+	m := &MultiClient{dests: make([]*destination, len(dests))}
+	for i, dest := range dests {
+		if dest.Prefix != "" {
+			dest.Prefix = strings.TrimRight(dest.Prefix, ".") + "."
+		}
+		if dest.Rate <= 0 {
+			dest.Rate = 1
+		}
+		if dest.QueueSize <= 0 {
+			dest.QueueSize = DefaultQueueSize
+		}
+		d := &destination{
+			Destination: dest,
+			queue:       make(chan func(), dest.QueueSize),
+			done:        make(chan struct{}),
+		}
+		go d.run()
+		m.dests[i] = d
+	}
+	return m
+}
+
+// Tee returns a client sending to all of clients, without a prefix or rate of their own.
+func Tee(clients ...StatsClient) *MultiClient {
+	dests := make([]Destination, len(clients))
+	for i, client := range clients {
+		dests[i] = Destination{Client: client}
+	}
+	return NewMultiClient(dests...)
+}
+
+// The optional methods of the richer Client that destinations may implement.
+type timingClient interface {
+	Timing(stat string, delta int, rate float64) error
+}
+
+type gaugeDeltaClient interface {
+	IncrementGauge(stat string, value int, rate float64) error
+	DecrementGauge(stat string, value int, rate float64) error
+}
+
+type flushClient interface {
+	Flush() error
+}
+
+var errNoGaugeDelta = errors.New("Destination does not support gauge deltas")
+
+// each queues send for every destination, with the stat and rate adjusted for it.
+func (m *MultiClient) each(stat string, rate float64, send func(client StatsClient, stat string, rate float64) error) error {
+	return m.eachSupporting(nil, stat, rate, send)
+}
+
+// eachSupporting is each, skipping the destinations for which supports returns an error.
+func (m *MultiClient) eachSupporting(supports func(StatsClient) error, stat string, rate float64, send func(client StatsClient, stat string, rate float64) error) error {
+	m.m.RLock()
+	defer m.m.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	var errs []error
+	for _, d := range m.dests {
+		if supports != nil {
+			if err := supports(d.Client); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		d := d
+		destStat, destRate := d.Prefix+stat, rate*d.Rate
+		select {
+		case d.queue <- func() { d.report(send(d.Client, destStat, destRate)) }:
+		default:
+			atomic.AddInt64(&d.dropped, 1)
+			errs = append(errs, ErrQueueFull)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// wait queues f for every destination, even when their queue is full, and waits for all of them to run it.
+func (m *MultiClient) wait(f func(d *destination)) error {
+	m.m.RLock()
+	if m.closed {
+		m.m.RUnlock()
+		return ErrClosed
+	}
+	var wg sync.WaitGroup
+	for _, d := range m.dests {
+		d := d
+		wg.Add(1)
+		d.queue <- func() {
+			defer wg.Done()
+			f(d)
+		}
+	}
+	m.m.RUnlock()
+	wg.Wait()
+	return nil
+}
+
+// Dropped returns how many stats were dropped because a destination's queue was full,
+// counting a stat once for every destination it was dropped for.
+func (m *MultiClient) Dropped() int64 {
+	var dropped int64
+	for _, d := range m.dests {
+		dropped += atomic.LoadInt64(&d.dropped)
+	}
+	return dropped
+}
+
+// Set the key prefix of every destination's client, see Client.SetPrefix.
+// It applies to the stats sent after it returns.
+func (m *MultiClient) SetPrefix(prefix string) {
+	m.wait(func(d *destination) {
+		d.Client.SetPrefix(prefix)
+	})
+}
+
+// Increment the counter for the given bucket.
+func (m *MultiClient) Increment(stat string, count int, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.Increment(stat, count, rate)
+	})
+}
+
+// Decrement the counter for the given bucket.
+func (m *MultiClient) Decrement(stat string, count int, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.Decrement(stat, count, rate)
+	})
+}
+
+// Record time spent for the given bucket with time.Duration.
+func (m *MultiClient) Duration(stat string, duration time.Duration, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.Duration(stat, duration, rate)
+	})
+}
+
+// Record time spent for the given bucket in milliseconds.
+// Destinations without a Timing method are sent a Duration instead.
+func (m *MultiClient) Timing(stat string, delta int, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		if t, ok := client.(timingClient); ok {
+			return t.Timing(stat, delta, rate)
+		}
+		return client.Duration(stat, time.Duration(delta)*time.Millisecond, rate)
+	})
+}
+
+// Calculate time spent in given function and send it. The function is only called once.
+func (m *MultiClient) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return m.Duration(stat, time.Since(ts), rate)
+}
+
+// Record arbitrary values for the given bucket.
+func (m *MultiClient) Gauge(stat string, value int, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.Gauge(stat, value, rate)
+	})
+}
+
+func supportsGaugeDelta(client StatsClient) error {
+	if _, ok := client.(gaugeDeltaClient); !ok {
+		return errNoGaugeDelta
+	}
+	return nil
+}
+
+// Increment the value of the gauge.
+func (m *MultiClient) IncrementGauge(stat string, value int, rate float64) error {
+	return m.eachSupporting(supportsGaugeDelta, stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.(gaugeDeltaClient).IncrementGauge(stat, value, rate)
+	})
+}
+
+// Decrement the value of the gauge.
+func (m *MultiClient) DecrementGauge(stat string, value int, rate float64) error {
+	return m.eachSupporting(supportsGaugeDelta, stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.(gaugeDeltaClient).DecrementGauge(stat, value, rate)
+	})
+}
+
+// Record unique occurences of events.
+func (m *MultiClient) Unique(stat string, value int, rate float64) error {
+	return m.each(stat, rate, func(client StatsClient, stat string, rate float64) error {
+		return client.Unique(stat, value, rate)
+	})
+}
+
+// Flush waits for the stats queued so far to be sent, and writes any buffered data of every
+// destination that buffers. Unlike sending stats, it waits for slow destinations.
+// It returns the errors of the stats sent since the previous Flush too.
+func (m *MultiClient) Flush() error {
+	err := m.wait(func(d *destination) {
+		if f, ok := d.Client.(flushClient); ok {
+			d.report(f.Flush())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return m.takeErrors()
+}
+
+// takeErrors returns the errors every destination kept, joined.
+func (m *MultiClient) takeErrors() error {
+	var errs []error
+	for _, d := range m.dests {
+		errs = append(errs, d.takeErrors()...)
+	}
+	return errors.Join(errs...)
+}
+
+// closeQueues stops accepting stats, and returns a channel closed once every destination has
+// sent what was queued.
+func (m *MultiClient) closeQueues() (<-chan struct{}, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	m.closed = true
+	for _, d := range m.dests {
+		close(d.queue)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, d := range m.dests {
+			<-d.done
+		}
+		close(drained)
+	}()
+	return drained, nil
+}
+
+// Sends the queued stats, then closes every destination.
+func (m *MultiClient) Close() error {
+	drained, err := m.closeQueues()
+	if err != nil {
+		return err
+	}
+	<-drained
+
+	errs := []error{m.takeErrors()}
+	for _, d := range m.dests {
+		if err := d.Client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown sends the queued stats and shuts every destination down within ctx, see Client.Shutdown.
+// Destinations that cannot be shut down are closed. Stats still queued when ctx is done are abandoned.
+func (m *MultiClient) Shutdown(ctx context.Context) error {
+	drained, err := m.closeQueues()
+	if err != nil {
+		return err
+	}
+
+	shutdownErr := &ShutdownError{}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		for _, d := range m.dests {
+			shutdownErr.Abandoned += len(d.queue)
+		}
+		shutdownErr.add(ctx.Err())
+	}
+	shutdownErr.add(m.takeErrors())
+
+	for _, d := range m.dests {
+		if s, ok := d.Client.(Shutdowner); ok {
+			shutdownErr.add(s.Shutdown(ctx))
+		} else {
+			shutdownErr.add(d.Client.Close())
+		}
+	}
+	return shutdownErr.orNil()
+}
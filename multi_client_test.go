@@ -0,0 +1,167 @@
+package statsdclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// failingClient fails every stat sent to it.
+type failingClient struct {
+	nullStatsClient
+}
+
+func (f *failingClient) Increment(stat string, count int, rate float64) error {
+	return errors.New("destination down")
+}
+
+func TestTee(t *testing.T) {
+	first := NewMockClient()
+	second := NewMockClient()
+	m := Tee(first, second)
+
+	err := m.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+	err = m.Timing("timing", 350, 1)
+	assert.Equal(t, err, nil)
+	err = m.IncrementGauge("gauge", 10, 1)
+	assert.Equal(t, err, nil)
+	err = m.Flush()
+	assert.Equal(t, err, nil)
+
+	for _, c := range []*MockClient{first, second} {
+		stat, _ := c.NextStat()
+		assert.Equal(t, stat, "incr:1|c")
+		stat, _ = c.NextStat()
+		assert.Equal(t, stat, "timing:350|ms")
+		stat, _ = c.NextStat()
+		assert.Equal(t, stat, "gauge:+10|g")
+	}
+}
+
+func TestMultiClientDestinations(t *testing.T) {
+	first := NewMockClient()
+	second := NewMockClient()
+	m := NewMultiClient(
+		Destination{Client: first, Prefix: "old..", Rate: 0.5},
+		Destination{Client: second, Prefix: "new"},
+	)
+
+	// a rate of 2 cancels out the first destination's rate
+	err := m.Gauge("gauge", 3, 2)
+	assert.Equal(t, err, nil)
+	err = m.Flush()
+	assert.Equal(t, err, nil)
+
+	stat, _ := first.NextStat()
+	assert.Equal(t, stat, "old.gauge:3|g")
+	stat, _ = second.NextStat()
+	assert.Equal(t, stat, "new.gauge:3|g")
+}
+
+func TestMultiClientErrors(t *testing.T) {
+	working := NewMockClient()
+	var em sync.Mutex
+	var reported int
+	onError := func(err error) {
+		em.Lock()
+		defer em.Unlock()
+		reported++
+	}
+	m := NewMultiClient(
+		Destination{Client: &failingClient{}, OnError: onError},
+		Destination{Client: NullStatsClient},
+		Destination{Client: working},
+		Destination{Client: &failingClient{}},
+	)
+
+	// sending is asynchronous, the errors are returned by Flush
+	err := m.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+	err = m.Flush()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, 2, strings.Count(err.Error(), "destination down"))
+	em.Lock()
+	assert.Equal(t, 1, reported)
+	em.Unlock()
+
+	// the working destination got the stat regardless
+	stat, _ := working.NextStat()
+	assert.Equal(t, stat, "incr:1|c")
+	assert.Equal(t, nil, m.Flush())
+
+	// destinations without gauge deltas report it
+	err = m.DecrementGauge("gauge", 1, 1)
+	assert.Equal(t, 3, strings.Count(err.Error(), errNoGaugeDelta.Error()))
+
+	// Close returns the errors not returned yet
+	for i := 0; i < maxDestinationErrors+5; i++ {
+		m.Increment("incr", 1, 1)
+	}
+	err = m.Duration("duration", time.Millisecond, 1)
+	assert.Equal(t, err, nil)
+	err = m.Close()
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, 2*maxDestinationErrors, strings.Count(err.Error(), "destination down"))
+	assert.Equal(t, 2, strings.Count(err.Error(), "5 more errors"))
+	assert.Equal(t, ErrClosed, m.Increment("incr", 1, 1))
+}
+
+// blockingClient blocks every stat sent to it until unblocked.
+type blockingClient struct {
+	nullStatsClient
+	unblock chan struct{}
+}
+
+func (b *blockingClient) Increment(stat string, count int, rate float64) error {
+	<-b.unblock
+	return nil
+}
+
+func TestMultiClientSlowDestination(t *testing.T) {
+	slow := &blockingClient{unblock: make(chan struct{})}
+	working := NewMockClient()
+	m := NewMultiClient(Destination{Client: slow, QueueSize: 2}, Destination{Client: working})
+
+	// one stat is being sent, two are queued and the rest are dropped for the slow destination only
+	done := make(chan error)
+	go func() {
+		var errs []error
+		for i := 0; i < 10; i++ {
+			errs = append(errs, m.Increment("incr", 1, 1))
+		}
+		done <- errors.Join(errs...)
+	}()
+	select {
+	case err := <-done:
+		assert.T(t, errors.Is(err, ErrQueueFull), "expected stats to be dropped")
+	case <-time.After(time.Second):
+		t.Fatal("the slow destination blocked the caller")
+	}
+	assert.T(t, working.WaitN(10, time.Second), "the working destination should get every stat")
+	dropped := m.Dropped()
+	assert.T(t, dropped >= 7 && dropped <= 8, "unexpected number of dropped stats")
+
+	close(slow.unblock)
+	assert.Equal(t, nil, m.Close())
+}
+
+func TestMultiClientShutdownDeadline(t *testing.T) {
+	slow := &blockingClient{unblock: make(chan struct{})}
+	defer close(slow.unblock)
+	m := NewMultiClient(Destination{Client: slow, QueueSize: 10})
+	for i := 0; i < 5; i++ {
+		m.Increment("incr", 1, 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := m.Shutdown(ctx)
+	assert.T(t, errors.Is(err, context.DeadlineExceeded), "expected the deadline to pass")
+	assert.Equal(t, 4, err.(*ShutdownError).Abandoned)
+}
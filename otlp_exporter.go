@@ -0,0 +1,551 @@
+package statsdclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOTLPBounds are the histogram bucket bounds of timers, in milliseconds, when OTLPConfig.Bounds is empty.
+var DefaultOTLPBounds = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// OTLPConfig configures an OTLPExporter.
+type OTLPConfig struct {
+	// The OTLP/HTTP metrics endpoint, for example "http://localhost:4318/v1/metrics"
+	Endpoint string
+
+	// How often metrics are exported, 10 seconds when zero
+	Interval time.Duration
+
+	// How long an export made in the background, by Flush or by Close may take, 10 seconds when zero
+	Timeout time.Duration
+
+	// Sent with every export request, for example for authentication
+	Headers map[string]string
+
+	// The attributes of the resource the metrics are about, for example "service.name"
+	Resource map[string]string
+
+	// The histogram bucket bounds of timers in milliseconds, DefaultOTLPBounds when empty
+	Bounds []float64
+
+	// How long gauges that are not updated keep their value for IncrementGauge and DecrementGauge,
+	// 10 intervals when zero
+	GaugeExpiry time.Duration
+
+	// The client exports are sent with, http.DefaultClient when nil
+	HTTPClient *http.Client
+
+	// Called with the errors of the exports made in the background, which are otherwise dropped,
+	// and with the names dropped for having stats of several types
+	OnError func(err error)
+}
+
+// An OTLPExporter is a StatsClient aggregating stats in memory and exporting them periodically
+// as OTLP metrics, JSON encoded over HTTP, for example to an OpenTelemetry collector.
+//
+// Counters become delta Sums, gauges Gauges, timers delta Histograms in milliseconds,
+// and sets Gauges of the number of unique values seen since the previous export.
+// OTLP metrics have a single type, so when stats of different types share a name, only those of
+// the first type in that order are exported, and the others are reported to OTLPConfig.OnError.
+// Since every call is aggregated, sample rates are ignored.
+// Metrics that could not be exported are dropped.
+type OTLPExporter struct {
+	cfg    OTLPConfig
+	client *http.Client
+
+	m      sync.Mutex
+	prefix string
+	closed bool
+	// The start of the current aggregation interval
+	start    time.Time
+	counters map[metricKey]int64
+	// Gauges keep their value between exports, like on statsd servers, until they expire,
+	// but are only exported when set
+	gauges  map[metricKey]otlpGaugeValue
+	updated map[metricKey]bool
+	timers  map[metricKey]*otlpHistogram
+	sets    map[metricKey]map[int]bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type otlpGaugeValue struct {
+	value   int64
+	updated time.Time
+}
+
+type otlpHistogram struct {
+	count         uint64
+	sum, min, max float64
+	buckets       []uint64
+}
+
+// NewOTLPExporter returns an exporter sending metrics to cfg.Endpoint every cfg.Interval, until it is closed.
+func NewOTLPExporter(cfg OTLPConfig) (*OTLPExporter, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("OTLP endpoint is required")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if len(cfg.Bounds) == 0 {
+		cfg.Bounds = DefaultOTLPBounds
+	}
+	if cfg.GaugeExpiry <= 0 {
+		cfg.GaugeExpiry = 10 * cfg.Interval
+	}
+	e := &OTLPExporter{
+		cfg:    cfg,
+		client: cfg.HTTPClient,
+		stop:   make(chan struct{}),
+	}
+	if e.client == nil {
+		e.client = http.DefaultClient
+	}
+	e.reset(time.Now())
+	e.gauges = map[metricKey]otlpGaugeValue{}
+
+	e.wg.Add(1)
+	go e.run()
+	return e, nil
+}
+
+// reset starts a new aggregation interval. Must be called with e.m held.
+func (e *OTLPExporter) reset(now time.Time) {
+	e.start = now
+	e.counters = map[metricKey]int64{}
+	e.updated = map[metricKey]bool{}
+	e.timers = map[metricKey]*otlpHistogram{}
+	e.sets = map[metricKey]map[int]bool{}
+}
+
+func (e *OTLPExporter) run() {
+	defer e.wg.Done()
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.exportWithTimeout(); err != nil && e.cfg.OnError != nil {
+				e.cfg.OnError(err)
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// record adds a stat to the current interval under the lock.
+func (e *OTLPExporter) record(stat string, tags []string, add func(key metricKey)) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if e.closed {
+		return ErrClosed
+	}
+	add(metricKey{name: e.prefix + stat, tags: tagKey(tags)})
+	return nil
+}
+
+// Set the key prefix of the exported metric names, see Client.SetPrefix.
+func (e *OTLPExporter) SetPrefix(prefix string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	e.prefix = strings.TrimRight(prefix, ".") + "."
+}
+
+func (e *OTLPExporter) increment(stat string, count int, tags []string) error {
+	return e.record(stat, tags, func(key metricKey) { e.counters[key] += int64(count) })
+}
+
+func (e *OTLPExporter) duration(stat string, duration time.Duration, tags []string) error {
+	ms := duration.Seconds() * 1000
+	return e.record(stat, tags, func(key metricKey) {
+		h := e.timers[key]
+		if h == nil {
+			h = &otlpHistogram{min: ms, max: ms, buckets: make([]uint64, len(e.cfg.Bounds)+1)}
+			e.timers[key] = h
+		}
+		h.count++
+		h.sum += ms
+		h.min = math.Min(h.min, ms)
+		h.max = math.Max(h.max, ms)
+		// buckets are (previous bound, bound], the last one has no upper bound
+		h.buckets[sort.SearchFloat64s(e.cfg.Bounds, ms)]++
+	})
+}
+
+func (e *OTLPExporter) gauge(stat string, value int, delta bool, tags []string) error {
+	return e.record(stat, tags, func(key metricKey) {
+		g := otlpGaugeValue{value: int64(value), updated: time.Now()}
+		if delta {
+			g.value += e.gauges[key].value
+		}
+		e.gauges[key] = g
+		e.updated[key] = true
+	})
+}
+
+func (e *OTLPExporter) unique(stat string, value int, tags []string) error {
+	return e.record(stat, tags, func(key metricKey) {
+		if e.sets[key] == nil {
+			e.sets[key] = map[int]bool{}
+		}
+		e.sets[key][value] = true
+	})
+}
+
+// Increment the counter for the given bucket.
+func (e *OTLPExporter) Increment(stat string, count int, rate float64) error {
+	return e.increment(stat, count, nil)
+}
+
+// Decrement the counter for the given bucket.
+func (e *OTLPExporter) Decrement(stat string, count int, rate float64) error {
+	return e.increment(stat, -count, nil)
+}
+
+// Record time spent for the given bucket with time.Duration.
+func (e *OTLPExporter) Duration(stat string, duration time.Duration, rate float64) error {
+	return e.duration(stat, duration, nil)
+}
+
+// Record time spent for the given bucket in milliseconds.
+func (e *OTLPExporter) Timing(stat string, delta int, rate float64) error {
+	return e.duration(stat, time.Duration(delta)*time.Millisecond, nil)
+}
+
+// Calculate time spent in given function and send it.
+func (e *OTLPExporter) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return e.Duration(stat, time.Since(ts), rate)
+}
+
+// Record arbitrary values for the given bucket.
+func (e *OTLPExporter) Gauge(stat string, value int, rate float64) error {
+	return e.gauge(stat, value, false, nil)
+}
+
+// Increment the value of the gauge.
+func (e *OTLPExporter) IncrementGauge(stat string, value int, rate float64) error {
+	return e.gauge(stat, value, true, nil)
+}
+
+// Decrement the value of the gauge.
+func (e *OTLPExporter) DecrementGauge(stat string, value int, rate float64) error {
+	return e.gauge(stat, -value, true, nil)
+}
+
+// Record unique occurences of events.
+func (e *OTLPExporter) Unique(stat string, value int, rate float64) error {
+	return e.unique(stat, value, nil)
+}
+
+// Tagged returns a client recording every stat with tags, exported as attributes of the data
+// points: "key:value" tags become the attribute key with the value, and "value" tags an attribute with an empty value.
+func (e *OTLPExporter) Tagged(tags ...string) StatsClient {
+	return &taggedRecorder{r: e, tags: tags}
+}
+
+// Flush exports the metrics aggregated so far, within cfg.Timeout.
+func (e *OTLPExporter) Flush() error {
+	e.m.Lock()
+	closed := e.closed
+	e.m.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return e.exportWithTimeout()
+}
+
+// Close stops exporting in the background and exports the metrics aggregated so far, within cfg.Timeout.
+func (e *OTLPExporter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	defer cancel()
+	return e.Shutdown(ctx)
+}
+
+// Shutdown stops accepting stats and exports the metrics aggregated so far within the deadline of ctx.
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	e.m.Lock()
+	if e.closed {
+		e.m.Unlock()
+		return ErrClosed
+	}
+	e.closed = true
+	e.m.Unlock()
+
+	close(e.stop)
+	e.wg.Wait()
+	return e.export(ctx)
+}
+
+func (e *OTLPExporter) exportWithTimeout() error {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	defer cancel()
+	return e.export(ctx)
+}
+
+// export sends the metrics of the current interval and starts a new one.
+func (e *OTLPExporter) export(ctx context.Context) error {
+	e.m.Lock()
+	now := time.Now()
+	metrics, conflicts := e.collect(now)
+	e.reset(now)
+	e.expire(now)
+	e.m.Unlock()
+
+	if e.cfg.OnError != nil {
+		for _, err := range conflicts {
+			e.cfg.OnError(err)
+		}
+	}
+
+	if len(metrics) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(e.request(metrics))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.cfg.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP export failed with status %s", resp.Status)
+	}
+	return nil
+}
+
+// expire forgets the gauges not updated for cfg.GaugeExpiry. Must be called with e.m held.
+func (e *OTLPExporter) expire(now time.Time) {
+	for key, g := range e.gauges {
+		if now.Sub(g.updated) >= e.cfg.GaugeExpiry {
+			delete(e.gauges, key)
+		}
+	}
+}
+
+// The OTLP JSON encoding, following the protobuf JSON mapping, where 64 bit integers are strings
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes,omitempty"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpAttribute struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpMetric struct {
+		Name      string             `json:"name"`
+		Unit      string             `json:"unit,omitempty"`
+		Sum       *otlpSum           `json:"sum,omitempty"`
+		Gauge     *otlpGauge         `json:"gauge,omitempty"`
+		Histogram *otlpHistogramData `json:"histogram,omitempty"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality int                   `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsInt             string          `json:"asInt"`
+	}
+	otlpHistogramData struct {
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		Min               float64         `json:"min"`
+		Max               float64         `json:"max"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+)
+
+// AGGREGATION_TEMPORALITY_DELTA
+const otlpDelta = 1
+
+func (e *OTLPExporter) request(metrics []otlpMetric) otlpRequest {
+	var resource otlpResource
+	for key, value := range e.cfg.Resource {
+		resource.Attributes = append(resource.Attributes, otlpAttribute{key, otlpAnyValue{value}})
+	}
+	sort.Slice(resource.Attributes, func(i, j int) bool { return resource.Attributes[i].Key < resource.Attributes[j].Key })
+
+	return otlpRequest{[]otlpResourceMetrics{{
+		Resource: resource,
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/sendgrid/go-statsdclient", Version: VERSION},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// The kinds of stats, of which only the first is exported when several have the same name
+const (
+	otlpSumKind = iota
+	otlpGaugeKind
+	otlpSetKind
+	otlpHistogramKind
+)
+
+var otlpKindNames = []string{"counters", "gauges", "sets", "timers"}
+
+// collect turns the current interval into OTLP metrics, one per name with a data point per set of
+// tags, sorted by name. It returns an error for every kind dropped because its name was taken by
+// another kind. Must be called with e.m held.
+func (e *OTLPExporter) collect(now time.Time) ([]otlpMetric, []error) {
+	type metricID struct {
+		name string
+		kind int
+	}
+	start, end := unixNano(e.start), unixNano(now)
+	byID := map[metricID]*otlpMetric{}
+	metric := func(name string, kind int) *otlpMetric {
+		id := metricID{name, kind}
+		if byID[id] == nil {
+			byID[id] = &otlpMetric{Name: name}
+		}
+		return byID[id]
+	}
+
+	for key, count := range e.counters {
+		m := metric(key.name, otlpSumKind)
+		if m.Sum == nil {
+			m.Sum = &otlpSum{AggregationTemporality: otlpDelta}
+		}
+		m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberDataPoint{otlpAttributes(key.tags), start, end, strconv.FormatInt(count, 10)})
+	}
+	for key := range e.updated {
+		m := metric(key.name, otlpGaugeKind)
+		if m.Gauge == nil {
+			m.Gauge = &otlpGauge{}
+		}
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{otlpAttributes(key.tags), "", end, strconv.FormatInt(e.gauges[key].value, 10)})
+	}
+	for key, values := range e.sets {
+		m := metric(key.name, otlpSetKind)
+		if m.Gauge == nil {
+			m.Gauge = &otlpGauge{}
+		}
+		m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberDataPoint{otlpAttributes(key.tags), "", end, strconv.Itoa(len(values))})
+	}
+	for key, h := range e.timers {
+		m := metric(key.name, otlpHistogramKind)
+		m.Unit = "ms"
+		if m.Histogram == nil {
+			m.Histogram = &otlpHistogramData{AggregationTemporality: otlpDelta}
+		}
+		buckets := make([]string, len(h.buckets))
+		for i, count := range h.buckets {
+			buckets[i] = strconv.FormatUint(count, 10)
+		}
+		m.Histogram.DataPoints = append(m.Histogram.DataPoints, otlpHistogramDataPoint{
+			Attributes:        otlpAttributes(key.tags),
+			StartTimeUnixNano: start,
+			TimeUnixNano:      end,
+			Count:             strconv.FormatUint(h.count, 10),
+			Sum:               h.sum,
+			Min:               h.min,
+			Max:               h.max,
+			BucketCounts:      buckets,
+			ExplicitBounds:    e.cfg.Bounds,
+		})
+	}
+
+	ids := make([]metricID, 0, len(byID))
+	for id := range byID {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].name != ids[j].name {
+			return ids[i].name < ids[j].name
+		}
+		return ids[i].kind < ids[j].kind
+	})
+	metrics := make([]otlpMetric, 0, len(ids))
+	var conflicts []error
+	var exported metricID
+	for i, id := range ids {
+		if i > 0 && exported.name == id.name {
+			conflicts = append(conflicts, fmt.Errorf("OTLP metric %s dropped its %s, it has %s of the same name",
+				id.name, otlpKindNames[id.kind], otlpKindNames[exported.kind]))
+			continue
+		}
+		exported = id
+		metrics = append(metrics, *byID[id])
+	}
+	return metrics, conflicts
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// otlpAttributes decodes the tags of a key into attributes.
+func otlpAttributes(tags string) []otlpAttribute {
+	if tags == "" {
+		return nil
+	}
+	var attributes []otlpAttribute
+	for _, tag := range splitTagKey(tags) {
+		key, value, _ := strings.Cut(tag, ":")
+		attributes = append(attributes, otlpAttribute{key, otlpAnyValue{value}})
+	}
+	return attributes
+}
@@ -0,0 +1,268 @@
+package statsdclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// otlpReceiver is an OTLP/HTTP endpoint keeping the requests it receives.
+type otlpReceiver struct {
+	*httptest.Server
+	m        sync.Mutex
+	requests []otlpRequest
+	headers  []http.Header
+	status   int
+}
+
+func newOTLPReceiver(t *testing.T) *otlpReceiver {
+	r := &otlpReceiver{status: http.StatusOK}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body otlpRequest
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request with content type %q", req.Method, req.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("could not decode the request: %s", err)
+		}
+		r.m.Lock()
+		defer r.m.Unlock()
+		r.requests = append(r.requests, body)
+		r.headers = append(r.headers, req.Header)
+		w.WriteHeader(r.status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *otlpReceiver) received() []otlpRequest {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]otlpRequest(nil), r.requests...)
+}
+
+// metrics returns the metrics of the only request received, by name.
+func (r *otlpReceiver) metrics(t *testing.T) map[string]otlpMetric {
+	t.Helper()
+	requests := r.received()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	metrics := map[string]otlpMetric{}
+	for _, m := range requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+	return metrics
+}
+
+func TestOTLPExporter(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint: receiver.URL,
+		Interval: time.Hour,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+		Resource: map[string]string{"service.name": "api"},
+		Bounds:   []float64{10, 100},
+	})
+	assert.Equal(t, nil, err)
+	e.SetPrefix("app")
+
+	e.Increment("requests", 3, 1)
+	e.Increment("requests", 2, 0.1)
+	e.Decrement("requests", 1, 1)
+	e.Gauge("connections", 10, 1)
+	e.IncrementGauge("connections", 5, 1)
+	e.DecrementGauge("connections", 2, 1)
+	e.Duration("latency", 5*time.Millisecond, 1)
+	e.Timing("latency", 50, 1)
+	e.Timing("latency", 500, 1)
+	e.Unique("users", 1, 1)
+	e.Unique("users", 2, 1)
+	e.Unique("users", 1, 1)
+	assert.Equal(t, nil, e.Flush())
+
+	requests := receiver.received()
+	assert.Equal(t, 1, len(requests))
+	assert.Equal(t, "Bearer token", receiver.headers[0].Get("Authorization"))
+	resource := requests[0].ResourceMetrics[0].Resource
+	assert.Equal(t, []otlpAttribute{{"service.name", otlpAnyValue{"api"}}}, resource.Attributes)
+	assert.Equal(t, VERSION, requests[0].ResourceMetrics[0].ScopeMetrics[0].Scope.Version)
+
+	metrics := receiver.metrics(t)
+	assert.Equal(t, 4, len(metrics))
+
+	sum := metrics["app.requests"].Sum
+	assert.NotEqual(t, nil, sum)
+	assert.Equal(t, otlpDelta, sum.AggregationTemporality)
+	assert.Equal(t, "4", sum.DataPoints[0].AsInt)
+
+	assert.Equal(t, "13", metrics["app.connections"].Gauge.DataPoints[0].AsInt)
+	assert.Equal(t, "2", metrics["app.users"].Gauge.DataPoints[0].AsInt)
+
+	latency := metrics["app.latency"]
+	assert.Equal(t, "ms", latency.Unit)
+	point := latency.Histogram.DataPoints[0]
+	assert.Equal(t, "3", point.Count)
+	assert.Equal(t, 555.0, point.Sum)
+	assert.Equal(t, 5.0, point.Min)
+	assert.Equal(t, 500.0, point.Max)
+	assert.Equal(t, []string{"1", "1", "1"}, point.BucketCounts)
+	assert.Equal(t, []float64{10, 100}, point.ExplicitBounds)
+
+	assert.Equal(t, nil, e.Close())
+}
+
+func TestOTLPExporterIntervals(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	e, _ := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL, Interval: time.Hour})
+	defer e.Close()
+
+	e.Increment("requests", 1, 1)
+	e.Gauge("connections", 3, 1)
+	e.Flush()
+	// nothing new, nothing sent
+	e.Flush()
+	assert.Equal(t, 1, len(receiver.received()))
+
+	// counters start over, gauges keep their value
+	e.Increment("requests", 2, 1)
+	e.IncrementGauge("connections", 1, 1)
+	e.Flush()
+	requests := receiver.received()
+	assert.Equal(t, 2, len(requests))
+	metrics := requests[1].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(t, "4", metrics[0].Gauge.DataPoints[0].AsInt)
+	assert.Equal(t, "2", metrics[1].Sum.DataPoints[0].AsInt)
+	// the interval starts where the previous one, sent or not, ended
+	first := requests[0].ResourceMetrics[0].ScopeMetrics[0].Metrics[1].Sum.DataPoints[0]
+	assert.T(t, metrics[1].Sum.DataPoints[0].StartTimeUnixNano > first.TimeUnixNano, "intervals do not overlap")
+}
+
+func TestOTLPExporterTagged(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	e, _ := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL, Interval: time.Hour})
+	defer e.Close()
+
+	tagged, ok := WithTags(e, "env:prod")
+	assert.T(t, ok, "an OTLPExporter supports tags")
+	tagged.Increment("requests", 1, 1)
+	tagged.(Tagger).Tagged("canary").Increment("requests", 1, 1)
+	e.Increment("requests", 1, 1)
+	assert.Equal(t, nil, tagged.Close())
+	e.Flush()
+
+	points := receiver.metrics(t)["requests"].Sum.DataPoints
+	assert.Equal(t, 3, len(points))
+	attributes := map[int][]otlpAttribute{}
+	for _, point := range points {
+		attributes[len(point.Attributes)] = point.Attributes
+	}
+	assert.Equal(t, []otlpAttribute{{"env", otlpAnyValue{"prod"}}}, attributes[1])
+	assert.Equal(t, []otlpAttribute{{"canary", otlpAnyValue{""}}, {"env", otlpAnyValue{"prod"}}}, attributes[2])
+}
+
+func TestOTLPExporterBackground(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	receiver.status = http.StatusServiceUnavailable
+	errs := make(chan error, 10)
+	e, _ := NewOTLPExporter(OTLPConfig{
+		Endpoint: receiver.URL,
+		Interval: 10 * time.Millisecond,
+		OnError:  func(err error) { errs <- err },
+	})
+	e.Increment("requests", 1, 1)
+
+	select {
+	case err := <-errs:
+		assert.NotEqual(t, nil, err)
+	case <-time.After(time.Second):
+		t.Fatal("expected an export error")
+	}
+	assert.Equal(t, nil, e.Shutdown(context.Background()))
+	assert.Equal(t, ErrClosed, e.Increment("requests", 1, 1))
+	assert.Equal(t, ErrClosed, e.Flush())
+	assert.Equal(t, ErrClosed, e.Close())
+}
+
+func TestOTLPExporterConfig(t *testing.T) {
+	_, err := NewOTLPExporter(OTLPConfig{})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestOTLPExporterTimeout(t *testing.T) {
+	// an endpoint that never answers
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) { <-hang }))
+	defer server.Close()
+	defer close(hang)
+	e, _ := NewOTLPExporter(OTLPConfig{Endpoint: server.URL, Interval: time.Hour, Timeout: 10 * time.Millisecond})
+
+	e.Increment("requests", 1, 1)
+	err := e.Flush()
+	assert.T(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	e.Increment("requests", 1, 1)
+	done := make(chan error)
+	go func() { done <- e.Close() }()
+	select {
+	case err := <-done:
+		assert.T(t, errors.Is(err, context.DeadlineExceeded), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to give up after the timeout")
+	}
+}
+
+func TestOTLPExporterKinds(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	var errs []error
+	e, _ := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL, Interval: time.Hour, OnError: func(err error) { errs = append(errs, err) }})
+	defer e.Close()
+
+	e.Gauge("connections", 2, 1)
+	e.Unique("users", 3, 1)
+	e.Timing("latency", 4, 1)
+	e.Flush()
+	metrics := receiver.received()[0].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(t, 3, len(metrics))
+	assert.Equal(t, "2", metrics[0].Gauge.DataPoints[0].AsInt)
+	assert.Equal(t, "ms", metrics[1].Unit)
+	assert.Equal(t, "1", metrics[2].Gauge.DataPoints[0].AsInt)
+	assert.Equal(t, "", metrics[2].Unit)
+	assert.Equal(t, 0, len(errs))
+
+	// a name has a single type, the first of counters, gauges, sets and timers
+	e.Increment("requests", 1, 1)
+	e.Gauge("requests", 2, 1)
+	e.Unique("requests", 3, 1)
+	e.Timing("requests", 4, 1)
+	e.Flush()
+	metrics = receiver.received()[1].ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "1", metrics[0].Sum.DataPoints[0].AsInt)
+	assert.Equal(t, 3, len(errs))
+	assert.Equal(t, "OTLP metric requests dropped its gauges, it has counters of the same name", errs[0].Error())
+}
+
+func TestOTLPExporterGaugeExpiry(t *testing.T) {
+	receiver := newOTLPReceiver(t)
+	e, _ := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL, Interval: time.Hour, GaugeExpiry: time.Nanosecond})
+	defer e.Close()
+
+	e.Gauge("connections", 3, 1)
+	e.Flush()
+	assert.Equal(t, 0, len(e.gauges))
+
+	// an expired gauge starts again from zero
+	e.IncrementGauge("connections", 1, 1)
+	e.Flush()
+	requests := receiver.received()
+	assert.Equal(t, 2, len(requests))
+	assert.Equal(t, "1", requests[1].ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Gauge.DataPoints[0].AsInt)
+}
@@ -0,0 +1,329 @@
+// Package procstats periodically reports the metrics of the current process and of its
+// cgroup v2 through a statsd client, as gauges. It reads the Linux /proc and /sys/fs/cgroup files:
+//
+//	collector := procstats.New(client, 10*time.Second)
+//	defer collector.Close()
+//
+// Under the prefix of the collector, "process" by default, it reports:
+//   - cpu.user and cpu.system, the CPU time used by the process in milliseconds
+//   - mem.rss, the resident set size in bytes
+//   - fds.open and fds.max, the open file descriptors and their soft limit
+//   - threads
+//   - ctx_switches.voluntary and ctx_switches.involuntary
+//   - cgroup.cpu.usage and cgroup.cpu.throttled, in milliseconds
+//   - cgroup.cpu.periods and cgroup.cpu.throttled_periods
+//   - cgroup.cpu.limit, in thousandths of a CPU, when the cgroup has a CPU quota
+//   - cgroup.memory.current and cgroup.memory.limit, in bytes, the latter when the cgroup has one
+//
+// Metrics that cannot be read, for example those of the cgroup on hosts without cgroup v2, are skipped.
+package procstats
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/internal/ticker"
+)
+
+// Defaults of the collector options
+const (
+	DefaultPrefix     = "process"
+	DefaultProcRoot   = "/proc"
+	DefaultCgroupRoot = "/sys/fs/cgroup"
+)
+
+// The clock ticks per second of the CPU times in /proc/self/stat. Linux always reports them as 100 per second.
+const userHZ = 100
+
+// An Option configures a Collector.
+type Option func(*Collector)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(c *Collector) { c.prefix = prefix }
+}
+
+// WithProcRoot sets the directory the proc filesystem is read from.
+func WithProcRoot(dir string) Option {
+	return func(c *Collector) { c.procRoot = dir }
+}
+
+// WithCgroupRoot sets the directory the cgroup v2 hierarchy is read from.
+func WithCgroupRoot(dir string) Option {
+	return func(c *Collector) { c.cgroupRoot = dir }
+}
+
+// A Collector periodically reports the metrics of the current process and of its cgroup.
+type Collector struct {
+	client     statsdclient.StatsClient
+	prefix     string
+	procRoot   string
+	cgroupRoot string
+
+	ticker *ticker.Ticker
+}
+
+// New returns a collector that reads the /proc and cgroup files every interval. Errors of the periodic
+// collections are dropped; call Collect to get them.
+func New(client statsdclient.StatsClient, interval time.Duration, opts ...Option) *Collector {
+	c := &Collector{
+		client:     client,
+		prefix:     DefaultPrefix,
+		procRoot:   DefaultProcRoot,
+		cgroupRoot: DefaultCgroupRoot,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.prefix != "" {
+		c.prefix += "."
+	}
+
+	c.ticker = ticker.Start(interval, func() { c.Collect() })
+	return c
+}
+
+// Close stops the collector, after the files being read, if any, are closed.
+func (c *Collector) Close() error {
+	c.ticker.Stop()
+	return nil
+}
+
+// Collect reports the metrics of the process now. Files that do not exist are skipped,
+// the errors reading the others are returned joined together.
+func (c *Collector) Collect() error {
+	var errs []error
+	for _, collect := range []func() error{c.collectStat, c.collectStatus, c.collectFDs, c.collectLimits, c.collectCgroup} {
+		if err := collect(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *Collector) gauge(bucket string, value int) {
+	c.client.Gauge(c.prefix+bucket, value, 1)
+}
+
+func (c *Collector) proc(name string) string {
+	return filepath.Join(c.procRoot, "self", name)
+}
+
+// collectStat reports the CPU times of /proc/self/stat.
+func (c *Collector) collectStat() error {
+	data, err := os.ReadFile(c.proc("stat"))
+	if err != nil {
+		return err
+	}
+	// the command name in parentheses may contain spaces, the fields after it do not
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return fmt.Errorf("Malformed %s", c.proc("stat"))
+	}
+	// fields start at the state, the third field of the file
+	fields := strings.Fields(string(data[i+1:]))
+	const utime, stime = 14 - 3, 15 - 3
+	if len(fields) <= stime {
+		return fmt.Errorf("Malformed %s", c.proc("stat"))
+	}
+	user, err := strconv.Atoi(fields[utime])
+	if err != nil {
+		return err
+	}
+	system, err := strconv.Atoi(fields[stime])
+	if err != nil {
+		return err
+	}
+	c.gauge("cpu.user", user*1000/userHZ)
+	c.gauge("cpu.system", system*1000/userHZ)
+	return nil
+}
+
+// collectStatus reports the RSS, threads and context switches of /proc/self/status.
+func (c *Collector) collectStatus() error {
+	values, err := readKeyValues(c.proc("status"), ":")
+	if err != nil {
+		return err
+	}
+	if rss, ok := values["VmRSS"]; ok {
+		c.gauge("mem.rss", parseSize(rss))
+	}
+	for key, bucket := range map[string]string{
+		"Threads":                    "threads",
+		"voluntary_ctxt_switches":    "ctx_switches.voluntary",
+		"nonvoluntary_ctxt_switches": "ctx_switches.involuntary",
+	} {
+		if value, err := strconv.Atoi(values[key]); err == nil {
+			c.gauge(bucket, value)
+		}
+	}
+	return nil
+}
+
+// collectFDs reports the number of open file descriptors, the entries of /proc/self/fd,
+// not counting the one open to list them.
+func (c *Collector) collectFDs() error {
+	dir, err := os.Open(c.proc("fd"))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return err
+	}
+	open := len(names)
+	self := strconv.Itoa(int(dir.Fd()))
+	for _, name := range names {
+		if name != self {
+			continue
+		}
+		if target, err := os.Readlink(filepath.Join(c.proc("fd"), name)); err == nil && filepath.Base(target) == "fd" {
+			open--
+		}
+	}
+	c.gauge("fds.open", open)
+	return nil
+}
+
+// collectLimits reports the soft limit of open files of /proc/self/limits.
+func (c *Collector) collectLimits() error {
+	data, err := os.ReadFile(c.proc("limits"))
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) > 0 {
+			if limit, err := strconv.Atoi(fields[0]); err == nil {
+				c.gauge("fds.max", limit)
+			}
+		}
+	}
+	return nil
+}
+
+// collectCgroup reports the CPU and memory of the cgroup v2 of the process.
+func (c *Collector) collectCgroup() error {
+	dir, err := c.cgroupDir()
+	if dir == "" || err != nil {
+		return err
+	}
+
+	var errs []error
+	if stat, err := readKeyValues(filepath.Join(dir, "cpu.stat"), " "); err == nil {
+		for key, bucket := range map[string]string{
+			"usage_usec":     "cgroup.cpu.usage",
+			"throttled_usec": "cgroup.cpu.throttled",
+		} {
+			if usec, err := strconv.Atoi(stat[key]); err == nil {
+				c.gauge(bucket, usec/1000)
+			}
+		}
+		for key, bucket := range map[string]string{
+			"nr_periods":   "cgroup.cpu.periods",
+			"nr_throttled": "cgroup.cpu.throttled_periods",
+		} {
+			if value, err := strconv.Atoi(stat[key]); err == nil {
+				c.gauge(bucket, value)
+			}
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	// "$MAX $PERIOD", or "max $PERIOD" without a quota
+	if data, err := os.ReadFile(filepath.Join(dir, "cpu.max")); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) == 2 {
+			quota, err1 := strconv.Atoi(fields[0])
+			period, err2 := strconv.Atoi(fields[1])
+			if err1 == nil && err2 == nil && period > 0 {
+				c.gauge("cgroup.cpu.limit", quota*1000/period)
+			}
+		}
+	} else {
+		errs = append(errs, err)
+	}
+
+	for file, bucket := range map[string]string{
+		"memory.current": "cgroup.memory.current",
+		"memory.max":     "cgroup.memory.limit",
+	} {
+		data, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// "max" without a limit
+		if value, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil {
+			c.gauge(bucket, value)
+		}
+	}
+
+	// skip the files the cgroup does not have, like cpu.max when the CPU controller is off
+	var failed []error
+	for _, err := range errs {
+		if !errors.Is(err, fs.ErrNotExist) {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// cgroupDir returns the directory of the cgroup v2 of the process, from its "0::" line in
+// /proc/self/cgroup. It is empty when the process is not in a cgroup v2.
+func (c *Collector) cgroupDir() (string, error) {
+	data, err := os.ReadFile(c.proc("cgroup"))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(c.cgroupRoot, filepath.Clean("/"+path)), nil
+		}
+	}
+	return "", nil
+}
+
+// readKeyValues reads a file of "key<sep>value" lines.
+func readKeyValues(path, sep string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), sep); ok {
+			values[key] = strings.TrimSpace(value)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// parseSize parses the "1784 kB" sizes of /proc/self/status into bytes.
+func parseSize(size string) int {
+	value, unit, _ := strings.Cut(size, " ")
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	if unit == "kB" {
+		n *= 1024
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package procstats
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+)
+
+func TestCollectFixture(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour, WithProcRoot("testdata/proc"), WithCgroupRoot("testdata/cgroup"))
+	defer c.Close()
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]float64{
+		"process.cpu.user":                     2500,
+		"process.cpu.system":                   1200,
+		"process.mem.rss":                      20480 * 1024,
+		"process.threads":                      12,
+		"process.ctx_switches.voluntary":       350,
+		"process.ctx_switches.involuntary":     42,
+		"process.fds.open":                     4,
+		"process.fds.max":                      1024,
+		"process.cgroup.cpu.usage":             5500,
+		"process.cgroup.cpu.throttled":         1250,
+		"process.cgroup.cpu.periods":           600,
+		"process.cgroup.cpu.throttled_periods": 25,
+		"process.cgroup.cpu.limit":             1500,
+		"process.cgroup.memory.current":        73400320,
+		"process.cgroup.memory.limit":          268435456,
+	}
+	for bucket, value := range expected {
+		statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket(bucket).Type(statsdclienttest.Gauge).Value(statsdclienttest.Equal(value)))
+	}
+	if n := len(client.Metrics()); n != len(expected) {
+		t.Errorf("got %d metrics, expected %d", n, len(expected))
+	}
+}
+
+func TestCollectWithoutLimits(t *testing.T) {
+	root := t.TempDir()
+	write := func(path, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("proc/self/cgroup", "0::/\n")
+	write("cgroup/cpu.max", "max 100000\n")
+	write("cgroup/memory.max", "max\n")
+	write("cgroup/memory.current", "1024\n")
+
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour, WithPrefix("p"), WithProcRoot(filepath.Join(root, "proc")), WithCgroupRoot(filepath.Join(root, "cgroup")))
+	defer c.Close()
+	// the missing files are skipped
+	if err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := client.Metrics()
+	if len(metrics) != 1 || metrics[0].String() != "p.cgroup.memory.current:1024|g" {
+		t.Errorf("expected only the current memory, got %v", metrics)
+	}
+}
+
+func TestCollectMalformed(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "self"), 0755)
+	os.WriteFile(filepath.Join(root, "self", "stat"), []byte("4242 (app"), 0644)
+
+	c := New(statsdclienttest.NewStatsClient(), time.Hour, WithProcRoot(root))
+	defer c.Close()
+	if err := c.Collect(); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestCollectSelf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(client.Metrics()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("process.fds.open").Value(statsdclienttest.GreaterThan(2)))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("process.mem.rss").Value(statsdclienttest.GreaterThan(0)))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("process.threads").Value(statsdclienttest.GreaterThan(0)))
+}
+
+func TestCollectFDsSelf(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads /proc")
+	}
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour)
+	defer c.Close()
+
+	if err := c.collectFDs(); err != nil {
+		t.Fatal(err)
+	}
+	// listing the directory opens one descriptor, which is not counted
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("process.fds.open").Value(statsdclienttest.Equal(float64(len(entries)-1))))
+}
@@ -0,0 +1,430 @@
+package statsdclient
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPrometheusBuckets are the histogram bucket bounds of timers, in seconds, of a new PrometheusSink.
+var DefaultPrometheusBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// DefaultPrometheusUniqueWindow is how long sets count unique values in a new PrometheusSink.
+const DefaultPrometheusUniqueWindow = time.Minute
+
+// A PrometheusSink is a StatsClient keeping stats in memory and serving them in the Prometheus
+// text exposition format, for environments that scrape metrics instead of accepting statsd pushes:
+//
+//	sink := statsdclient.NewPrometheusSink()
+//	http.Handle("/metrics", sink)
+//
+// Buckets are made into Prometheus names by replacing the characters they cannot have with "_",
+// "http.requests" becoming "http_requests", and tags into labels, "env:prod" becoming env="prod"
+// and "canary" canary="true".
+// Counters are exposed as counters named with a "_total" suffix, and since those may not decrease,
+// negative increments are dropped. Gauges are gauges, and so are sets, of how many unique values were
+// seen in the current window, see SetUniqueWindow. Timers are histograms in seconds, named with a
+// "_seconds" suffix. Suffixes are not added to names that already end with them: "requests_total"
+// stays "requests_total".
+// Since every call is kept, sample rates are ignored.
+//
+// When stats make the same Prometheus name with another type, or the same series, only the first of
+// them is exposed, counters coming before gauges, sets and timers, and each by bucket and tags.
+type PrometheusSink struct {
+	m        sync.Mutex
+	prefix   string
+	closed   bool
+	buckets  []float64
+	counters map[metricKey]float64
+	gauges   map[metricKey]float64
+	timers   map[metricKey]*promHistogram
+	sets     map[metricKey]map[int]bool
+	// How long sets count unique values, and the start of the current window
+	window      time.Duration
+	windowStart time.Time
+	now         func() time.Time
+}
+
+type promHistogram struct {
+	// The bounds when the timer was first recorded
+	bounds []float64
+	count  uint64
+	sum    float64
+	// Observations of each bucket, not cumulative
+	buckets []uint64
+}
+
+// NewPrometheusSink returns an empty sink.
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		buckets:     DefaultPrometheusBuckets,
+		counters:    map[metricKey]float64{},
+		gauges:      map[metricKey]float64{},
+		timers:      map[metricKey]*promHistogram{},
+		sets:        map[metricKey]map[int]bool{},
+		window:      DefaultPrometheusUniqueWindow,
+		windowStart: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Set how long sets count unique values before starting again from zero, whatever the scrapes.
+// The current window is then counted from its start with the new length.
+func (p *PrometheusSink) SetUniqueWindow(window time.Duration) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.window = window
+}
+
+// Set the histogram bucket bounds of timers, in seconds. Timers already recorded keep their buckets.
+func (p *PrometheusSink) SetBuckets(bounds ...float64) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.buckets = append([]float64(nil), bounds...)
+	sort.Float64s(p.buckets)
+}
+
+// Set the key prefix of the exposed metric names, see Client.SetPrefix.
+func (p *PrometheusSink) SetPrefix(prefix string) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.prefix = strings.TrimRight(prefix, ".") + "."
+}
+
+// record adds a stat under the lock.
+func (p *PrometheusSink) record(stat string, tags []string, add func(key metricKey)) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	add(metricKey{name: p.prefix + stat, tags: tagKey(tags)})
+	return nil
+}
+
+func (p *PrometheusSink) increment(stat string, count int, tags []string) error {
+	if count < 0 {
+		return nil
+	}
+	return p.record(stat, tags, func(key metricKey) { p.counters[key] += float64(count) })
+}
+
+func (p *PrometheusSink) duration(stat string, duration time.Duration, tags []string) error {
+	seconds := duration.Seconds()
+	return p.record(stat, tags, func(key metricKey) {
+		h := p.timers[key]
+		if h == nil {
+			h = &promHistogram{bounds: p.buckets, buckets: make([]uint64, len(p.buckets))}
+			p.timers[key] = h
+		}
+		h.count++
+		h.sum += seconds
+		// the +Inf bucket is the count
+		if i := sort.SearchFloat64s(h.bounds, seconds); i < len(h.buckets) {
+			h.buckets[i]++
+		}
+	})
+}
+
+func (p *PrometheusSink) gauge(stat string, value int, delta bool, tags []string) error {
+	return p.record(stat, tags, func(key metricKey) {
+		if delta {
+			p.gauges[key] += float64(value)
+		} else {
+			p.gauges[key] = float64(value)
+		}
+	})
+}
+
+func (p *PrometheusSink) unique(stat string, value int, tags []string) error {
+	return p.record(stat, tags, func(key metricKey) {
+		p.rollWindow()
+		if p.sets[key] == nil {
+			p.sets[key] = map[int]bool{}
+		}
+		p.sets[key][value] = true
+	})
+}
+
+// rollWindow empties the sets once their window is over, keeping them exposed with no values.
+// Must be called with p.m held.
+func (p *PrometheusSink) rollWindow() {
+	now := p.now()
+	if now.Sub(p.windowStart) < p.window {
+		return
+	}
+	p.windowStart = now
+	for _, values := range p.sets {
+		clear(values)
+	}
+}
+
+// Increment the counter for the given bucket.
+func (p *PrometheusSink) Increment(stat string, count int, rate float64) error {
+	return p.increment(stat, count, nil)
+}
+
+// Decrement does nothing, Prometheus counters cannot decrease.
+func (p *PrometheusSink) Decrement(stat string, count int, rate float64) error {
+	return p.increment(stat, -count, nil)
+}
+
+// Record time spent for the given bucket with time.Duration.
+func (p *PrometheusSink) Duration(stat string, duration time.Duration, rate float64) error {
+	return p.duration(stat, duration, nil)
+}
+
+// Record time spent for the given bucket in milliseconds.
+func (p *PrometheusSink) Timing(stat string, delta int, rate float64) error {
+	return p.duration(stat, time.Duration(delta)*time.Millisecond, nil)
+}
+
+// Calculate time spent in given function and send it.
+func (p *PrometheusSink) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return p.Duration(stat, time.Since(ts), rate)
+}
+
+// Record arbitrary values for the given bucket.
+func (p *PrometheusSink) Gauge(stat string, value int, rate float64) error {
+	return p.gauge(stat, value, false, nil)
+}
+
+// Increment the value of the gauge.
+func (p *PrometheusSink) IncrementGauge(stat string, value int, rate float64) error {
+	return p.gauge(stat, value, true, nil)
+}
+
+// Decrement the value of the gauge.
+func (p *PrometheusSink) DecrementGauge(stat string, value int, rate float64) error {
+	return p.gauge(stat, -value, true, nil)
+}
+
+// Record unique occurences of events.
+func (p *PrometheusSink) Unique(stat string, value int, rate float64) error {
+	return p.unique(stat, value, nil)
+}
+
+// Tagged returns a client recording every stat with tags, exposed as labels.
+func (p *PrometheusSink) Tagged(tags ...string) StatsClient {
+	return &taggedRecorder{r: p, tags: tags}
+}
+
+// Close stops accepting stats. What was recorded is still served.
+func (p *PrometheusSink) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	return nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// A metric family of the exposition
+type promFamily struct {
+	name, typ string
+	series    []promSeries
+	// The labels of the series, to drop duplicates
+	labels map[string]bool
+}
+
+// The samples of one label set of a family
+type promSeries struct {
+	labels  string
+	samples []promSample
+}
+
+type promSample struct {
+	// The suffix of the family name, "_bucket" for example
+	suffix string
+	labels string
+	value  float64
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format, families sorted by name
+// and series by labels.
+func (p *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	p.m.Lock()
+	p.rollWindow()
+	families := map[string]*promFamily{}
+	// The families by the names of their samples, which other families may not use
+	owners := map[string]*promFamily{}
+	add := func(name, typ string, key metricKey, samples ...promSample) {
+		f := families[name]
+		if f == nil {
+			names := []string{name}
+			if typ == "histogram" {
+				names = append(names, name+"_bucket", name+"_sum", name+"_count")
+			}
+			for _, name := range names {
+				if owners[name] != nil {
+					return
+				}
+			}
+			f = &promFamily{name: name, typ: typ, labels: map[string]bool{}}
+			families[name] = f
+			for _, name := range names {
+				owners[name] = f
+			}
+		}
+		labels := promLabels(key.tags, "")
+		if f.typ != typ || f.labels[labels] {
+			return
+		}
+		f.labels[labels] = true
+		f.series = append(f.series, promSeries{labels: labels, samples: samples})
+	}
+
+	for _, key := range sortedMetricKeys(p.counters) {
+		add(promSuffixed(key.name, "_total"), "counter", key, promSample{"", promLabels(key.tags, ""), p.counters[key]})
+	}
+	for _, key := range sortedMetricKeys(p.gauges) {
+		add(promName(key.name), "gauge", key, promSample{"", promLabels(key.tags, ""), p.gauges[key]})
+	}
+	for _, key := range sortedMetricKeys(p.sets) {
+		add(promName(key.name), "gauge", key, promSample{"", promLabels(key.tags, ""), float64(len(p.sets[key]))})
+	}
+	for _, key := range sortedMetricKeys(p.timers) {
+		h := p.timers[key]
+		samples := make([]promSample, 0, len(h.bounds)+3)
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.buckets[i]
+			samples = append(samples, promSample{"_bucket", promLabels(key.tags, formatPromValue(bound)), float64(cumulative)})
+		}
+		labels := promLabels(key.tags, "")
+		samples = append(samples,
+			promSample{"_bucket", promLabels(key.tags, "+Inf"), float64(h.count)},
+			promSample{"_sum", labels, h.sum},
+			promSample{"_count", labels, float64(h.count)},
+		)
+		add(promSuffixed(key.name, "_seconds"), "histogram", key, samples...)
+	}
+	p.m.Unlock()
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		sort.Slice(f.series, func(i, j int) bool { return f.series[i].labels < f.series[j].labels })
+		buf.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+		for _, series := range f.series {
+			for _, sample := range series.samples {
+				buf.WriteString(f.name + sample.suffix + sample.labels + " " + formatPromValue(sample.value) + "\n")
+			}
+		}
+	}
+	return buf.WriteTo(w)
+}
+
+// sortedMetricKeys returns the keys of m sorted by name and tags.
+func sortedMetricKeys[V any](m map[metricKey]V) []metricKey {
+	keys := make([]metricKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].tags < keys[j].tags
+	})
+	return keys
+}
+
+// promSuffixed returns the Prometheus name of name ending with suffix, added if it is not already there.
+func promSuffixed(name, suffix string) string {
+	name = promName(name)
+	if strings.HasSuffix(name, suffix) {
+		return name
+	}
+	return name + suffix
+}
+
+// promName makes name a valid Prometheus metric name, [a-zA-Z_][a-zA-Z0-9_]*.
+// Colons are valid too, but reserved for recording rules.
+func promName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// promLabelName makes name a valid label name. Names starting with "__" are reserved, and so is "le",
+// the bucket bound of histograms.
+func promLabelName(name string) string {
+	name = promName(name)
+	if strings.HasPrefix(name, "__") || name == "le" {
+		name = "x" + name
+	}
+	return name
+}
+
+// promLabels formats the tags of a key as labels, with an le label last when not empty.
+// Of tags making the same label name, the first one is kept.
+func promLabels(tags string, le string) string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, tag := range splitTagKey(tags) {
+		name, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			value = "true"
+		}
+		name = promLabelName(name)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		labels = append(labels, name+`="`+escapePromLabel(value)+`"`)
+	}
+	if le != "" {
+		labels = append(labels, `le="`+le+`"`)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapePromLabel(value string) string {
+	return promLabelEscaper.Replace(value)
+}
+
+func formatPromValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
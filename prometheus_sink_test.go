@@ -0,0 +1,299 @@
+package statsdclient
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func scrape(t *testing.T, sink *PrometheusSink) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	sink.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	body, _ := io.ReadAll(rec.Body)
+	checkExposition(t, string(body))
+	return string(body)
+}
+
+var (
+	promTypeLine   = regexp.MustCompile(`^# TYPE ([a-zA-Z_][a-zA-Z0-9_]*) (counter|gauge|histogram)$`)
+	promSampleLine = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\\n]|\\["\\n])*",?)*\})? (\S+)$`)
+	promLabelPair  = regexp.MustCompile(`([a-zA-Z_][a-zA-Z0-9_]*)="((?:[^"\\\n]|\\["\\n])*)"`)
+)
+
+// checkExposition fails t unless body follows the text exposition format: every family is
+// declared once before its samples, which are not interleaved with other families, sample
+// names match their family, samples and their label names are unique, and histograms have
+// cumulative buckets ending in +Inf and equal to _count.
+func checkExposition(t *testing.T, body string) {
+	t.Helper()
+	if body != "" && !strings.HasSuffix(body, "\n") {
+		t.Errorf("exposition does not end with a newline: %q", body)
+	}
+	declared := map[string]string{}
+	samples := map[string]bool{}
+	var family, typ string
+	var buckets []float64
+	var les []float64
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if m := promTypeLine.FindStringSubmatch(line); m != nil {
+			if _, ok := declared[m[1]]; ok {
+				t.Errorf("family %s declared twice", m[1])
+			}
+			family, typ = m[1], m[2]
+			declared[family] = typ
+			continue
+		}
+		m := promSampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("invalid line %q", line)
+			continue
+		}
+		name, labels, value := m[1], m[2], m[3]
+		if samples[name+labels] {
+			t.Errorf("duplicate sample %q", line)
+		}
+		samples[name+labels] = true
+		labelNames := map[string]bool{}
+		for _, pair := range promLabelPair.FindAllStringSubmatch(labels, -1) {
+			if labelNames[pair[1]] {
+				t.Errorf("duplicate label %s in %q", pair[1], line)
+			}
+			labelNames[pair[1]] = true
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Errorf("invalid value in %q", line)
+		}
+		switch {
+		case typ == "histogram" && name == family+"_bucket":
+			pairs := promLabelPair.FindAllStringSubmatch(labels, -1)
+			last := pairs[len(pairs)-1]
+			if last[1] != "le" {
+				t.Errorf("bucket without le label: %q", line)
+				continue
+			}
+			le, _ := strconv.ParseFloat(last[2], 64)
+			if len(les) > 0 && (le <= les[len(les)-1] || v < buckets[len(buckets)-1]) {
+				t.Errorf("bucket out of order or not cumulative: %q", line)
+			}
+			les, buckets = append(les, le), append(buckets, v)
+		case typ == "histogram" && name == family+"_sum":
+			if len(les) == 0 || !math.IsInf(les[len(les)-1], 1) {
+				t.Errorf("histogram %s has no +Inf bucket before its sum", family)
+			}
+		case typ == "histogram" && name == family+"_count":
+			if len(buckets) == 0 || buckets[len(buckets)-1] != v {
+				t.Errorf("histogram %s count %s does not match its +Inf bucket", family, value)
+			}
+			les, buckets = nil, nil
+		case name != family || typ == "histogram":
+			t.Errorf("sample %q outside of its family %s", line, family)
+		}
+	}
+}
+
+func TestPrometheusSinkExposition(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.SetBuckets(0.1, 1)
+	sink.SetPrefix("app")
+
+	sink.Increment("http.requests", 3, 1)
+	sink.Increment("http.requests", 2, 0.5)
+	sink.Decrement("http.requests", 1, 1)
+	sink.Gauge("queue.depth", 10, 1)
+	sink.IncrementGauge("queue.depth", 5, 1)
+	sink.DecrementGauge("queue.depth", 2, 1)
+	sink.Unique("users", 1, 1)
+	sink.Unique("users", 2, 1)
+	sink.Unique("users", 1, 1)
+	sink.Duration("db.query", 50*time.Millisecond, 1)
+	sink.Timing("db.query", 500, 1)
+	sink.Duration("db.query", 2*time.Second, 1)
+
+	assert.Equal(t, `# TYPE app_db_query_seconds histogram
+app_db_query_seconds_bucket{le="0.1"} 1
+app_db_query_seconds_bucket{le="1"} 2
+app_db_query_seconds_bucket{le="+Inf"} 3
+app_db_query_seconds_sum 2.55
+app_db_query_seconds_count 3
+# TYPE app_http_requests_total counter
+app_http_requests_total 5
+# TYPE app_queue_depth gauge
+app_queue_depth 13
+# TYPE app_users gauge
+app_users 2
+`, scrape(t, sink))
+}
+
+func TestPrometheusSinkEmpty(t *testing.T) {
+	assert.Equal(t, "", scrape(t, NewPrometheusSink()))
+}
+
+func TestPrometheusSinkLabels(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Tagged("env:prod", "route:/users").Increment("requests", 1, 1)
+	sink.Tagged("route:/users", "env:prod").Increment("requests", 1, 1)
+	sink.Tagged("env:dev").Increment("requests", 1, 1)
+	sink.Increment("requests", 1, 1)
+	tagged, ok := WithTags(sink, "canary", "canary:false", "msg:say \"hi\"\\\nbye", "__name__:x", "0day:1")
+	assert.T(t, ok, "the sink should support tags")
+	tagged.Gauge("temp", -3, 1)
+
+	assert.Equal(t, `# TYPE requests_total counter
+requests_total 1
+requests_total{env="dev"} 1
+requests_total{env="prod",route="/users"} 2
+# TYPE temp gauge
+temp{_0day="1",x__name__="x",canary="true",msg="say \"hi\"\\\nbye"} -3
+`, scrape(t, sink))
+}
+
+func TestPrometheusSinkTaggedHistogram(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.SetBuckets(1)
+	sink.Tagged("op:write").Duration("latency", 2*time.Second, 1)
+	sink.Tagged("op:read").Duration("latency", 500*time.Millisecond, 1)
+
+	assert.Equal(t, `# TYPE latency_seconds histogram
+latency_seconds_bucket{op="read",le="1"} 1
+latency_seconds_bucket{op="read",le="+Inf"} 1
+latency_seconds_sum{op="read"} 0.5
+latency_seconds_count{op="read"} 1
+latency_seconds_bucket{op="write",le="1"} 0
+latency_seconds_bucket{op="write",le="+Inf"} 1
+latency_seconds_sum{op="write"} 2
+latency_seconds_count{op="write"} 1
+`, scrape(t, sink))
+}
+
+func TestPrometheusSinkDefaultBuckets(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Duration("t", 5*time.Millisecond, 1)
+	body := scrape(t, sink)
+	assert.T(t, strings.Contains(body, "t_seconds_bucket{le=\"0.005\"} 1\n"), body)
+	assert.T(t, strings.Contains(body, "t_seconds_bucket{le=\"10\"} 1\n"), body)
+	assert.Equal(t, len(DefaultPrometheusBuckets)+4, strings.Count(body, "\n"))
+}
+
+func TestPrometheusName(t *testing.T) {
+	for name, exp := range map[string]string{
+		"http.requests":     "http_requests",
+		"a-b:c d/e":         "a_b_c_d_e",
+		"5xx":               "_5xx",
+		"Already_valid_123": "Already_valid_123",
+		"héllo":             "h__llo",
+		"":                  "_",
+	} {
+		assert.Equal(t, exp, promName(name))
+	}
+}
+
+func TestPrometheusSinkClose(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Increment("before", 1, 1)
+	assert.Equal(t, nil, sink.Close())
+	assert.Equal(t, ErrClosed, sink.Increment("after", 1, 1))
+	assert.Equal(t, ErrClosed, sink.Close())
+	assert.Equal(t, "# TYPE before_total counter\nbefore_total 1\n", scrape(t, sink))
+}
+
+func TestPrometheusSinkWriteTo(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.Gauge("g", 1, 1)
+	var buf bytes.Buffer
+	n, err := sink.WriteTo(&buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, "# TYPE g gauge\ng 1\n", buf.String())
+}
+
+func TestPrometheusSinkCollisions(t *testing.T) {
+	sink := NewPrometheusSink()
+	// the same name with another type
+	sink.Increment("req", 1, 1)
+	sink.Gauge("req_total", 2, 1)
+	sink.Gauge("latency_seconds_count", 3, 1)
+	sink.Timing("latency", 100, 1)
+	// the same series
+	sink.Gauge("a.b", 4, 1)
+	sink.Unique("a_b", 5, 1)
+	sink.Increment("c.d", 6, 1)
+	sink.Increment("c_d", 7, 1)
+	// a label of the bucket bound
+	sink.SetBuckets(1)
+	sink.Tagged("le:x").Duration("t", time.Second, 1)
+
+	assert.Equal(t, `# TYPE a_b gauge
+a_b 4
+# TYPE c_d_total counter
+c_d_total 6
+# TYPE latency_seconds_count gauge
+latency_seconds_count 3
+# TYPE req_total counter
+req_total 1
+# TYPE t_seconds histogram
+t_seconds_bucket{xle="x",le="1"} 1
+t_seconds_bucket{xle="x",le="+Inf"} 1
+t_seconds_sum{xle="x"} 1
+t_seconds_count{xle="x"} 1
+`, scrape(t, sink))
+}
+
+func TestPrometheusSinkSuffixes(t *testing.T) {
+	sink := NewPrometheusSink()
+	sink.SetBuckets(1)
+	// names that already have their suffix
+	sink.Increment("requests_total", 1, 1)
+	sink.Timing("latency_seconds", 100, 1)
+	// gauges of the names counters make, with their suffix added or not
+	sink.Increment("errors", 2, 1)
+	sink.Gauge("errors_total", 3, 1)
+	sink.Gauge("requests_total", 4, 1)
+
+	assert.Equal(t, `# TYPE errors_total counter
+errors_total 2
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} 1
+latency_seconds_bucket{le="+Inf"} 1
+latency_seconds_sum 0.1
+latency_seconds_count 1
+# TYPE requests_total counter
+requests_total 1
+`, scrape(t, sink))
+}
+
+func TestPrometheusSinkSetWindow(t *testing.T) {
+	sink := NewPrometheusSink()
+	now := time.Now()
+	sink.now = func() time.Time { return now }
+	sink.windowStart = now
+	sink.SetUniqueWindow(time.Minute)
+
+	sink.Unique("users", 1, 1)
+	sink.Unique("users", 2, 1)
+	assert.Equal(t, "# TYPE users gauge\nusers 2\n", scrape(t, sink))
+	// scrapes do not reset sets
+	sink.Unique("users", 3, 1)
+	assert.Equal(t, "# TYPE users gauge\nusers 3\n", scrape(t, sink))
+
+	// the end of the window does
+	now = now.Add(time.Minute)
+	assert.Equal(t, "# TYPE users gauge\nusers 0\n", scrape(t, sink))
+	sink.Unique("users", 1, 1)
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, "# TYPE users gauge\nusers 1\n", scrape(t, sink))
+}
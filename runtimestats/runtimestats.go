@@ -0,0 +1,315 @@
+// Package runtimestats periodically reports the metrics of the Go runtime through a statsd client.
+//
+//	collector := runtimestats.New(client, 10*time.Second)
+//	defer collector.Close()
+//
+// Metrics are read with runtime/metrics, and with runtime.ReadMemStats when the runtime does not
+// support some of them.
+package runtimestats
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/internal/ticker"
+)
+
+// Buckets are the buckets the metrics are sent to, under the prefix of the collector.
+// An empty bucket turns its metric off.
+type Buckets struct {
+	// Gauges, in bytes
+	HeapInUse   string
+	HeapGoal    string
+	TotalMemory string
+
+	// Gauges
+	HeapObjects string
+	Goroutines  string
+	GOMAXPROCS  string
+
+	// Counters, of what happened since the previous collection
+	GCCycles   string
+	AllocBytes string
+	CGOCalls   string
+
+	// A timer of every GC pause since the previous collection
+	GCPause string
+
+	// Gauges of the 50th, 90th and 99th percentiles of the time goroutines spent runnable
+	// before running since the previous collection, in microseconds, with ".p50", ".p90"
+	// and ".p99" appended. Only reported by runtime/metrics.
+	SchedLatency string
+}
+
+// DefaultBuckets returns the buckets of a collector without WithBuckets.
+func DefaultBuckets() Buckets {
+	return Buckets{
+		HeapInUse:    "mem.heap.in_use",
+		HeapGoal:     "mem.heap.goal",
+		TotalMemory:  "mem.total",
+		HeapObjects:  "mem.heap.objects",
+		Goroutines:   "goroutines",
+		GOMAXPROCS:   "gomaxprocs",
+		GCCycles:     "gc.cycles",
+		AllocBytes:   "mem.alloc_bytes",
+		CGOCalls:     "cgo.calls",
+		GCPause:      "gc.pause",
+		SchedLatency: "sched.latency",
+	}
+}
+
+// Default bucket prefix
+const DefaultPrefix = "runtime"
+
+// At most how many GC pauses a collection sends, the rest are dropped
+const maxPauses = 256
+
+// An Option configures a Collector.
+type Option func(*Collector)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(c *Collector) { c.prefix = prefix }
+}
+
+// WithBuckets sets the buckets the metrics are sent to, see DefaultBuckets.
+func WithBuckets(buckets Buckets) Option {
+	return func(c *Collector) { c.buckets = buckets }
+}
+
+// WithMemStats reads every metric with runtime.ReadMemStats instead of runtime/metrics.
+// ReadMemStats stops the world, and does not report scheduling latencies.
+func WithMemStats() Option {
+	return func(c *Collector) { c.memStats = true }
+}
+
+// A Collector periodically reports the metrics of the Go runtime.
+type Collector struct {
+	client   statsdclient.StatsClient
+	prefix   string
+	buckets  Buckets
+	memStats bool
+
+	// Guards the state below, so that Collect can be called while the collector runs
+	m       sync.Mutex
+	samples []metrics.Sample
+	// Cumulative values as of the previous collection
+	gcCycles, allocBytes, cgoCalls uint64
+	pauses, schedLatencies         []uint64
+
+	ticker *ticker.Ticker
+}
+
+// The runtime/metrics read by a collector, in the order of its samples
+var sampleNames = []string{
+	"/memory/classes/heap/objects:bytes",
+	"/memory/classes/heap/unused:bytes",
+	"/gc/heap/goal:bytes",
+	"/memory/classes/total:bytes",
+	"/gc/heap/objects:objects",
+	"/sched/goroutines:goroutines",
+	"/sched/gomaxprocs:threads",
+	"/gc/cycles/total:gc-cycles",
+	"/gc/heap/allocs:bytes",
+	"/cgo/go-to-c-calls:calls",
+	"/sched/pauses/total/gc:seconds",
+	"/sched/latencies:seconds",
+}
+
+const (
+	sampleHeapObjectsBytes = iota
+	sampleHeapUnused
+	sampleHeapGoal
+	sampleTotalMemory
+	sampleHeapObjects
+	sampleGoroutines
+	sampleGOMAXPROCS
+	sampleGCCycles
+	sampleAllocBytes
+	sampleCGOCalls
+	sampleGCPauses
+	sampleSchedLatencies
+)
+
+// New returns a collector that reads the metrics of the runtime every interval. Counters and histograms
+// are reported as their changes since the previous read, so the first interval reports what happened since New.
+func New(client statsdclient.StatsClient, interval time.Duration, opts ...Option) *Collector {
+	c := &Collector{
+		client:  client,
+		prefix:  DefaultPrefix,
+		buckets: DefaultBuckets(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.prefix != "" {
+		c.prefix += "."
+	}
+	c.samples = make([]metrics.Sample, len(sampleNames))
+	for i, name := range sampleNames {
+		c.samples[i].Name = name
+	}
+
+	c.ticker = ticker.Start(interval, c.Collect)
+	return c
+}
+
+// Close stops the collector. It waits for a collection in progress, and returns once no more metrics are sent.
+func (c *Collector) Close() error {
+	c.ticker.Stop()
+	return nil
+}
+
+// Collect reports the metrics of the runtime now.
+func (c *Collector) Collect() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if !c.memStats {
+		metrics.Read(c.samples)
+		for _, sample := range c.samples {
+			if sample.Value.Kind() == metrics.KindBad {
+				// an older runtime
+				c.collectMemStats()
+				return
+			}
+		}
+		c.collectMetrics()
+		return
+	}
+	c.collectMemStats()
+}
+
+func (c *Collector) collectMetrics() {
+	value := func(i int) uint64 {
+		return c.samples[i].Value.Uint64()
+	}
+	c.gauge(c.buckets.HeapInUse, value(sampleHeapObjectsBytes)+value(sampleHeapUnused))
+	c.gauge(c.buckets.HeapGoal, value(sampleHeapGoal))
+	c.gauge(c.buckets.TotalMemory, value(sampleTotalMemory))
+	c.gauge(c.buckets.HeapObjects, value(sampleHeapObjects))
+	c.gauge(c.buckets.Goroutines, value(sampleGoroutines))
+	c.gauge(c.buckets.GOMAXPROCS, value(sampleGOMAXPROCS))
+	c.counter(c.buckets.GCCycles, value(sampleGCCycles), &c.gcCycles)
+	c.counter(c.buckets.AllocBytes, value(sampleAllocBytes), &c.allocBytes)
+	c.counter(c.buckets.CGOCalls, value(sampleCGOCalls), &c.cgoCalls)
+
+	pauses := c.samples[sampleGCPauses].Value.Float64Histogram()
+	if c.buckets.GCPause != "" {
+		sent := 0
+		forEachDelta(pauses, c.pauses, func(seconds float64, count uint64) {
+			for ; count > 0 && sent < maxPauses; count-- {
+				c.client.Duration(c.prefix+c.buckets.GCPause, time.Duration(seconds*float64(time.Second)), 1)
+				sent++
+			}
+		})
+	}
+	c.pauses = append(c.pauses[:0], pauses.Counts...)
+
+	latencies := c.samples[sampleSchedLatencies].Value.Float64Histogram()
+	if c.buckets.SchedLatency != "" {
+		for _, q := range []struct {
+			suffix   string
+			quantile float64
+		}{{".p50", 0.5}, {".p90", 0.9}, {".p99", 0.99}} {
+			if seconds, ok := quantile(latencies, c.schedLatencies, q.quantile); ok {
+				c.client.Gauge(c.prefix+c.buckets.SchedLatency+q.suffix, int(seconds*1e6), 1)
+			}
+		}
+	}
+	c.schedLatencies = append(c.schedLatencies[:0], latencies.Counts...)
+}
+
+func (c *Collector) collectMemStats() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	c.gauge(c.buckets.HeapInUse, stats.HeapInuse)
+	c.gauge(c.buckets.HeapGoal, stats.NextGC)
+	c.gauge(c.buckets.TotalMemory, stats.Sys)
+	c.gauge(c.buckets.HeapObjects, stats.HeapObjects)
+	c.gauge(c.buckets.Goroutines, uint64(runtime.NumGoroutine()))
+	c.gauge(c.buckets.GOMAXPROCS, uint64(runtime.GOMAXPROCS(0)))
+
+	previous := c.gcCycles
+	c.counter(c.buckets.GCCycles, uint64(stats.NumGC), &c.gcCycles)
+	c.counter(c.buckets.AllocBytes, stats.TotalAlloc, &c.allocBytes)
+	c.counter(c.buckets.CGOCalls, uint64(runtime.NumCgoCall()), &c.cgoCalls)
+
+	// PauseNs is a circular buffer of the most recent pauses
+	if c.buckets.GCPause != "" {
+		for gc := uint64(stats.NumGC); gc > previous && uint64(stats.NumGC)-gc < min(maxPauses, uint64(len(stats.PauseNs))); gc-- {
+			pause := stats.PauseNs[(gc+uint64(len(stats.PauseNs))-1)%uint64(len(stats.PauseNs))]
+			c.client.Duration(c.prefix+c.buckets.GCPause, time.Duration(pause), 1)
+		}
+	}
+}
+
+func (c *Collector) gauge(bucket string, value uint64) {
+	if bucket != "" {
+		c.client.Gauge(c.prefix+bucket, clamp(value), 1)
+	}
+}
+
+// counter sends how much value grew since the previous collection.
+func (c *Collector) counter(bucket string, value uint64, previous *uint64) {
+	if bucket != "" && value > *previous {
+		c.client.Increment(c.prefix+bucket, clamp(value-*previous), 1)
+	}
+	*previous = value
+}
+
+func clamp(value uint64) int {
+	if value > math.MaxInt {
+		return math.MaxInt
+	}
+	return int(value)
+}
+
+// forEachDelta calls f with a value of every bucket of h that grew since previous, and by how much.
+func forEachDelta(h *metrics.Float64Histogram, previous []uint64, f func(value float64, count uint64)) {
+	for i, count := range h.Counts {
+		if i < len(previous) {
+			count -= previous[i]
+		}
+		if count > 0 {
+			f(bucketValue(h, i), count)
+		}
+	}
+}
+
+// quantile returns the q quantile of the values h received since previous.
+func quantile(h *metrics.Float64Histogram, previous []uint64, q float64) (float64, bool) {
+	var total uint64
+	forEachDelta(h, previous, func(_ float64, count uint64) { total += count })
+	if total == 0 {
+		return 0, false
+	}
+
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	result := 0.0
+	forEachDelta(h, previous, func(value float64, count uint64) {
+		if seen < rank {
+			result = value
+		}
+		seen += count
+	})
+	return result, true
+}
+
+// bucketValue returns a value representing bucket i of h: its upper bound, or its lower bound
+// when it is unbounded.
+func bucketValue(h *metrics.Float64Histogram, i int) float64 {
+	if upper := h.Buckets[i+1]; !math.IsInf(upper, 1) {
+		return upper
+	}
+	if lower := h.Buckets[i]; !math.IsInf(lower, -1) {
+		return lower
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package runtimestats
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+)
+
+func testCollect(t *testing.T, opts ...Option) {
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour, opts...)
+	defer c.Close()
+
+	c.Collect()
+	runtime.GC()
+	c.Collect()
+
+	for _, m := range []*statsdclienttest.Matcher{
+		statsdclienttest.Bucket("runtime.mem.heap.in_use").Type(statsdclienttest.Gauge).Value(statsdclienttest.GreaterThan(0)),
+		statsdclienttest.Bucket("runtime.mem.heap.goal").Type(statsdclienttest.Gauge),
+		statsdclienttest.Bucket("runtime.mem.total").Type(statsdclienttest.Gauge).Value(statsdclienttest.GreaterThan(0)),
+		statsdclienttest.Bucket("runtime.mem.heap.objects").Type(statsdclienttest.Gauge),
+		statsdclienttest.Bucket("runtime.goroutines").Type(statsdclienttest.Gauge).Value(statsdclienttest.GreaterThan(1)),
+		statsdclienttest.Bucket("runtime.gomaxprocs").Value(statsdclienttest.Equal(float64(runtime.GOMAXPROCS(0)))),
+		statsdclienttest.Bucket("runtime.gc.cycles").Type(statsdclienttest.Counter).Value(statsdclienttest.GreaterThan(0)),
+		statsdclienttest.Bucket("runtime.mem.alloc_bytes").Type(statsdclienttest.Counter),
+		statsdclienttest.Bucket("runtime.gc.pause").Type(statsdclienttest.Timer),
+	} {
+		statsdclienttest.AssertMatch(t, client, m)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	testCollect(t)
+}
+
+func TestCollectMemStats(t *testing.T) {
+	testCollect(t, WithMemStats())
+}
+
+func TestCounterDeltas(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour)
+	defer c.Close()
+
+	runtime.GC()
+	c.Collect()
+	before := len(client.Metrics())
+	runtime.GC()
+	runtime.GC()
+	c.Collect()
+
+	var cycles float64
+	for _, m := range client.Metrics()[before:] {
+		if m.Bucket == "runtime.gc.cycles" {
+			cycles += m.Float()
+		}
+	}
+	if cycles < 2 {
+		t.Errorf("expected at least 2 GC cycles since the previous collection, got %g", cycles)
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Hour, WithPrefix("app.rt"), WithBuckets(Buckets{Goroutines: "g"}))
+	defer c.Close()
+	c.Collect()
+
+	metrics := client.Metrics()
+	if len(metrics) != 1 || metrics[0].Bucket != "app.rt.g" {
+		t.Errorf("expected only app.rt.g, got %v", metrics)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	c := New(client, time.Millisecond, WithBuckets(Buckets{Goroutines: "g"}))
+	deadline := time.Now().Add(time.Second)
+	for len(client.Metrics()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+	c.Close()
+
+	n := len(client.Metrics())
+	if n < 3 {
+		t.Fatalf("expected the collector to run every interval, got %d collections", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if len(client.Metrics()) != n {
+		t.Error("expected no stats after Close")
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	h := &metrics.Float64Histogram{
+		Counts:  []uint64{10, 60, 25, 5},
+		Buckets: []float64{math.Inf(-1), 0.001, 0.01, 0.1, math.Inf(1)},
+	}
+	tests := []struct {
+		previous []uint64
+		q        float64
+		expected float64
+	}{
+		{nil, 0.5, 0.01},
+		{nil, 0.9, 0.1},
+		{nil, 0.99, 0.1},
+		{[]uint64{10, 60, 25, 0}, 0.5, 0.1},
+	}
+	for _, test := range tests {
+		got, ok := quantile(h, test.previous, test.q)
+		if !ok || got != test.expected {
+			t.Errorf("quantile(%v, %g) = %g, %v, expected %g", test.previous, test.q, got, ok, test.expected)
+		}
+	}
+	if _, ok := quantile(h, h.Counts, 0.5); ok {
+		t.Error("expected no quantile without new values")
+	}
+}
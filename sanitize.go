@@ -0,0 +1,101 @@
+package statsdclient
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+// SanitizeMode decides what happens to prefixes, buckets and tags containing characters
+// that would corrupt the statsd line protocol.
+type SanitizeMode int
+
+const (
+	// Replace invalid characters with "_". This is the default.
+	SanitizeReplace SanitizeMode = iota
+	// Refuse to send the stat and return ErrInvalidName.
+	SanitizeReject
+	// Send names exactly as given.
+	SanitizePassThrough
+)
+
+// ErrInvalidName is returned when a bucket or tag cannot be sent as it is.
+var ErrInvalidName = errors.New("Stat name contains invalid characters")
+
+// invalidBucketByte reports whether b would break a line when used in a bucket name.
+// The rule is the parser's, so that whatever the client sends parses.
+func invalidBucketByte(b byte) bool {
+	return statsdproto.InvalidBucketByte(b)
+}
+
+// invalidTagByte reports whether b would break a line when used in a tag.
+// Colons are allowed since they separate the key from the value.
+func invalidTagByte(b byte) bool {
+	switch b {
+	case '|', ',', '#', ' ':
+		return true
+	}
+	return b < 0x20 || b == 0x7f
+}
+
+// dotsToUnderscores is the rule MakeStatsdPrefix makes host names into a single segment with.
+func dotsToUnderscores(s string) string {
+	return strings.Replace(s, ".", "_", -1)
+}
+
+// SanitizeSegment makes s a single segment of a bucket name: dots become "_", as MakeStatsdPrefix
+// does with host names, and so do the characters that are not allowed in buckets.
+func SanitizeSegment(s string) string {
+	segment, _ := sanitize(dotsToUnderscores(s), SanitizeReplace, invalidBucketByte)
+	return segment
+}
+
+// sanitize applies mode to name, using invalid to find the characters to replace or reject.
+// Names that are already valid are returned as is without allocating.
+func sanitize(name string, mode SanitizeMode, invalid func(byte) bool) (string, error) {
+	if mode == SanitizePassThrough {
+		return name, nil
+	}
+	if name == "" {
+		return "", ErrInvalidName
+	}
+
+	i := 0
+	for i < len(name) && !invalid(name[i]) {
+		i++
+	}
+	if i == len(name) {
+		return name, nil
+	}
+	if mode == SanitizeReject {
+		return "", ErrInvalidName
+	}
+
+	b := []byte(name)
+	for ; i < len(b); i++ {
+		if invalid(b[i]) {
+			b[i] = '_'
+		}
+	}
+	return string(b), nil
+}
+
+// formatTags builds the "|#a,b" tag section of a line from tags, skipping empty ones.
+func formatTags(tags []string, mode SanitizeMode) (string, error) {
+	valid := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		tag, err := sanitize(tag, mode, invalidTagByte)
+		if err != nil {
+			return "", err
+		}
+		valid = append(valid, tag)
+	}
+	if len(valid) == 0 {
+		return "", nil
+	}
+	return "|#" + strings.Join(valid, ","), nil
+}
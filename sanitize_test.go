@@ -0,0 +1,124 @@
+package statsdclient
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+var sanitizeTests = []struct {
+	stat     string
+	mode     SanitizeMode
+	expected string
+	err      error
+}{
+	{"valid.bucket-name_1", SanitizeReplace, "valid.bucket-name_1:1|c", nil},
+	{"bad:bucket|name@x#y z\n", SanitizeReplace, "bad_bucket_name_x_y_z_:1|c", nil},
+	{"bad:bucket", SanitizeReject, "", ErrInvalidName},
+	{"valid.bucket", SanitizeReject, "valid.bucket:1|c", nil},
+	{"", SanitizeReplace, "", ErrInvalidName},
+}
+
+func TestSanitize(t *testing.T) {
+	for _, test := range sanitizeTests {
+		c := NewMockClient()
+		c.SetSanitizer(test.mode)
+		err := c.Increment(test.stat, 1, 1)
+		assert.Equal(t, err, test.err, test.stat)
+		err = c.Flush()
+		assert.Equal(t, err, nil)
+		stat, _ := c.NextStat()
+		assert.Equal(t, stat, test.expected, test.stat)
+	}
+}
+
+func TestSanitizePrefixAndTags(t *testing.T) {
+	c := NewMockClient()
+	c.SetPrefix("my app")
+	c.SetTags("env:prod|x", "", "a,b")
+	err := c.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+
+	c.SetSanitizer(SanitizeReject)
+	err = c.Increment("incr", 1, 1)
+	assert.Equal(t, err, ErrInvalidName)
+	c.SetTags("env:prod")
+	err = c.Increment("incr", 1, 1)
+	assert.Equal(t, err, ErrInvalidName)
+
+	c.SetSanitizer(SanitizePassThrough)
+	c.SetTags("env:prod")
+	err = c.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+
+	err = c.Flush()
+	assert.Equal(t, err, nil)
+	stat, _ := c.NextStat()
+	assert.Equal(t, stat, "my_app.incr:1|c|#env:prod_x,a_b")
+	stat, _ = c.NextStat()
+	assert.Equal(t, stat, "my app.incr:1|c|#env:prod")
+}
+
+func TestSanitizeValidDoesNotAllocate(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		sanitize("valid.bucket.name", SanitizeReplace, invalidBucketByte)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+// checkLine fails the test unless line is a single well formed statsd line.
+func checkLine(t *testing.T, line string) {
+	m, err := statsdproto.ParseLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != statsdproto.Counter || m.Value != "1" {
+		t.Fatalf("got %+v from %q, expected a counter of 1", m, line)
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	f.Add("prefix", "bucket", "env:prod")
+	f.Add("pre:fix", "buck|et@0.5", "a,b|#c")
+	f.Add("", "line\nbreak", " ")
+	f.Fuzz(func(t *testing.T, prefix, stat, tag string) {
+		rec := &packetRecorder{}
+		c := newClient(rec, PacketSizeLoopback)
+		c.SetPrefix(prefix)
+		c.SetTags(tag)
+		if err := c.Increment(stat, 1, 1); err != nil {
+			if err == ErrInvalidName || err == ErrLineTooLong {
+				return
+			}
+			t.Fatal(err)
+		}
+		if err := c.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.packets) != 1 {
+			t.Fatalf("got %d packets, expected 1", len(rec.packets))
+		}
+		checkLine(t, rec.packets[0])
+	})
+}
+
+func TestSanitizeSegment(t *testing.T) {
+	assert.Equal(t, "host_example_com", SanitizeSegment("host.example.com"))
+	assert.Equal(t, "a_b_c", SanitizeSegment("a:b|c"))
+	assert.Equal(t, "plain", SanitizeSegment("plain"))
+	assert.Equal(t, "", SanitizeSegment(""))
+
+	// MakeStatsdPrefix only replaces dots, the client sanitizes the rest as it sends
+	assert.Equal(t, "env.app.host:1_example_com.", MakeStatsdPrefix("env", "app", "host:1.example.com"))
+}
+
+func TestSanitizedBucketsParse(t *testing.T) {
+	for b := 0; b < 256; b++ {
+		bucket, err := sanitize("a"+string([]byte{byte(b)})+"b", SanitizeReplace, invalidBucketByte)
+		assert.Equal(t, nil, err)
+		if _, err := statsdproto.ParseLine(bucket + ":1|c"); err != nil {
+			t.Errorf("byte %#x: %s", b, err)
+		}
+	}
+}
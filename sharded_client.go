@@ -0,0 +1,384 @@
+package statsdclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Number of points each node gets on the hash ring. More points spread buckets more evenly.
+const shardReplicas = 160
+
+var errUnknownNode = errors.New("Unknown statsd node")
+
+type shardNode struct {
+	addr    string
+	client  *Client
+	conn    *shardConn
+	healthy bool
+}
+
+// shardConn keeps the last write error of a node's connection, since its client drops the errors
+// of the flushes a full buffer triggers.
+type shardConn struct {
+	io.WriteCloser
+	m   sync.Mutex
+	err error
+}
+
+func (c *shardConn) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	if err != nil {
+		c.m.Lock()
+		c.err = err
+		c.m.Unlock()
+	}
+	return n, err
+}
+
+func (c *shardConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.WriteCloser.(writeDeadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// takeErr returns the last write error and forgets it.
+func (c *shardConn) takeErr() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	err := c.err
+	c.err = nil
+	return err
+}
+
+type ringPoint struct {
+	hash uint32
+	node *shardNode
+}
+
+// A ShardedClient spreads stats over a cluster of statsd servers, always sending a bucket to the same
+// server so that it is aggregated in one place. Buckets are placed with a consistent hash, so adding or
+// removing a server only moves the buckets that belong to it.
+//
+// A server is marked unhealthy when sending to it fails with a network error, or when it fails its
+// health check, see SetHealthCheck. Its buckets are sent to the next healthy server on the ring until
+// it passes a health check again. Over UDP send errors are rare, so health checks are what notice
+// most servers going down.
+type ShardedClient struct {
+	m      sync.RWMutex
+	size   int
+	prefix string
+	nodes  map[string]*shardNode
+	ring   []ringPoint
+
+	// Held while replacing the health check
+	checkM sync.Mutex
+	// Closed to stop the running health check
+	stopChecks chan struct{}
+	checks     sync.WaitGroup
+}
+
+// DialSharded connects to every one of addrs, see Dial.
+func DialSharded(addrs ...string) (*ShardedClient, error) {
+	return DialShardedSize(0, addrs...)
+}
+
+// DialShardedSize acts like DialSharded but takes a packet size, see DialSize.
+func DialShardedSize(size int, addrs ...string) (*ShardedClient, error) {
+	s := &ShardedClient{
+		size:  size,
+		nodes: make(map[string]*shardNode),
+	}
+	for _, addr := range addrs {
+		if err := s.AddNode(addr); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	s.SetHealthCheck(defaultRecoveryInterval, probeUDP)
+	return s, nil
+}
+
+// SetHealthCheck replaces the health check run on every node each interval, healthy or not.
+// A node is marked healthy when check passes and unhealthy when it fails.
+// By default the check sends an empty UDP datagram to each node every 10 seconds and watches for a port
+// unreachable reply. An interval of zero stops checking, leaving nodes marked as they are.
+func (s *ShardedClient) SetHealthCheck(interval time.Duration, check func(addr string) error) {
+	s.checkM.Lock()
+	defer s.checkM.Unlock()
+	if s.stopChecks != nil {
+		close(s.stopChecks)
+		s.stopChecks = nil
+	}
+	s.checks.Wait()
+	if interval <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	s.stopChecks = stop
+	s.checks.Add(1)
+	go func() {
+		defer s.checks.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.checkNodes(check)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// checkNodes runs check on every node, without holding s.m while it runs.
+func (s *ShardedClient) checkNodes(check func(addr string) error) {
+	s.m.RLock()
+	nodes := make([]*shardNode, 0, len(s.nodes))
+	for _, node := range s.nodes {
+		nodes = append(nodes, node)
+	}
+	s.m.RUnlock()
+
+	healthy := make([]bool, len(nodes))
+	for i, node := range nodes {
+		healthy[i] = check(node.addr) == nil
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for i, node := range nodes {
+		node.healthy = healthy[i]
+	}
+}
+
+// AddNode connects to addr and moves its share of the buckets to it.
+// Adding a node that is already present does nothing.
+func (s *ShardedClient) AddNode(addr string) error {
+	s.m.RLock()
+	_, ok := s.nodes[addr]
+	size := s.size
+	s.m.RUnlock()
+	if ok {
+		return nil
+	}
+
+	// dial without holding the lock, so that sending is not held up by the lookup
+	client, err := DialSize(addr, size)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.nodes[addr]; ok {
+		// added by someone else in the meantime
+		return client.Close()
+	}
+	if s.prefix != "" {
+		client.SetPrefix(s.prefix)
+	}
+	conn := &shardConn{WriteCloser: client.conn}
+	client.conn = conn
+	node := &shardNode{addr: addr, client: client, conn: conn, healthy: true}
+	s.nodes[addr] = node
+
+	for i := 0; i < shardReplicas; i++ {
+		s.ring = append(s.ring, ringPoint{crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i))), node})
+	}
+	sort.Slice(s.ring, func(i, j int) bool { return s.ring[i].hash < s.ring[j].hash })
+	return nil
+}
+
+// RemoveNode moves the buckets of addr to the remaining nodes and closes its connection.
+func (s *ShardedClient) RemoveNode(addr string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	node, ok := s.nodes[addr]
+	if !ok {
+		return errUnknownNode
+	}
+	delete(s.nodes, addr)
+
+	ring := s.ring[:0]
+	for _, point := range s.ring {
+		if point.node != node {
+			ring = append(ring, point)
+		}
+	}
+	s.ring = ring
+	return node.client.Close()
+}
+
+// SetHealthy marks addr as healthy or unhealthy until its next health check. The buckets of an
+// unhealthy node are sent to the next healthy node on the ring.
+func (s *ShardedClient) SetHealthy(addr string, healthy bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	node, ok := s.nodes[addr]
+	if !ok {
+		return errUnknownNode
+	}
+	node.healthy = healthy
+	return nil
+}
+
+// nodeFor returns the node stat is sent to: the first healthy node at or after its hash on the ring.
+// When every node is unhealthy the bucket's own node is used anyway. Must be called with s.m held.
+func (s *ShardedClient) nodeFor(stat string) *shardNode {
+	if len(s.ring) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(stat))
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	for i := 0; i < len(s.ring); i++ {
+		node := s.ring[(start+i)%len(s.ring)].node
+		if node.healthy {
+			return node
+		}
+	}
+	return s.ring[start%len(s.ring)].node
+}
+
+// send sends stat to its node, and marks the node unhealthy when that fails with a network error.
+func (s *ShardedClient) send(stat string, send func(client *Client) error) error {
+	s.m.RLock()
+	node := s.nodeFor(stat)
+	if node == nil {
+		s.m.RUnlock()
+		return errUnknownNode
+	}
+	err := send(node.client)
+	if writeErr := node.conn.takeErr(); err == nil {
+		err = writeErr
+	}
+	s.m.RUnlock()
+
+	if isNetworkError(err) {
+		s.m.Lock()
+		node.healthy = false
+		s.m.Unlock()
+		return fmt.Errorf("%s: %w", node.addr, err)
+	}
+	return err
+}
+
+// isNetworkError reports whether err comes from the connection rather than from the stat itself.
+func isNetworkError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Set the key prefix for every node, see Client.SetPrefix.
+// Buckets are placed on the ring by their name without the prefix.
+func (s *ShardedClient) SetPrefix(prefix string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.prefix = prefix
+	for _, node := range s.nodes {
+		node.client.SetPrefix(prefix)
+	}
+}
+
+// Increment the counter for the given bucket.
+func (s *ShardedClient) Increment(stat string, count int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Increment(stat, count, rate) })
+}
+
+// Decrement the counter for the given bucket.
+func (s *ShardedClient) Decrement(stat string, count int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Decrement(stat, count, rate) })
+}
+
+// Record time spent for the given bucket with time.Duration.
+func (s *ShardedClient) Duration(stat string, duration time.Duration, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Duration(stat, duration, rate) })
+}
+
+// Record time spent for the given bucket in milliseconds.
+func (s *ShardedClient) Timing(stat string, delta int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Timing(stat, delta, rate) })
+}
+
+// Calculate time spent in given function and send it.
+func (s *ShardedClient) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return s.Duration(stat, time.Since(ts), rate)
+}
+
+// Record arbitrary values for the given bucket.
+func (s *ShardedClient) Gauge(stat string, value int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Gauge(stat, value, rate) })
+}
+
+// Increment the value of the gauge.
+func (s *ShardedClient) IncrementGauge(stat string, value int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.IncrementGauge(stat, value, rate) })
+}
+
+// Decrement the value of the gauge.
+func (s *ShardedClient) DecrementGauge(stat string, value int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.DecrementGauge(stat, value, rate) })
+}
+
+// Record unique occurences of events.
+func (s *ShardedClient) Unique(stat string, value int, rate float64) error {
+	return s.send(stat, func(client *Client) error { return client.Unique(stat, value, rate) })
+}
+
+// Flush writes any buffered data to every node. Nodes that fail to flush are marked unhealthy.
+func (s *ShardedClient) Flush() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var errs []error
+	for _, node := range s.nodes {
+		err := node.client.Flush()
+		node.conn.takeErr()
+		if err != nil {
+			node.healthy = false
+			errs = append(errs, fmt.Errorf("%s: %w", node.addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Closes the connection to every node.
+func (s *ShardedClient) Close() error {
+	s.SetHealthCheck(0, nil)
+	s.m.Lock()
+	defer s.m.Unlock()
+	var errs []error
+	for addr, node := range s.nodes {
+		if err := node.client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(s.nodes, addr)
+	}
+	s.ring = nil
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts every node down within ctx, see Client.Shutdown.
+func (s *ShardedClient) Shutdown(ctx context.Context) error {
+	s.SetHealthCheck(0, nil)
+	s.m.Lock()
+	defer s.m.Unlock()
+	shutdownErr := &ShutdownError{}
+	for addr, node := range s.nodes {
+		shutdownErr.add(node.client.Shutdown(ctx))
+		delete(s.nodes, addr)
+	}
+	s.ring = nil
+	return shutdownErr.orNil()
+}
@@ -0,0 +1,206 @@
+package statsdclient
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// nodeAddr returns the address stat is currently sent to.
+func (s *ShardedClient) nodeAddr(stat string) string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if node := s.nodeFor(stat); node != nil {
+		return node.addr
+	}
+	return ""
+}
+
+// readLines returns every line listener receives until it has been quiet for a while.
+func readLines(listener *net.UDPConn) []string {
+	var lines []string
+	buf := make([]byte, PacketSizeLoopback)
+	for {
+		listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, err := listener.Read(buf)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func shardBuckets() []string {
+	buckets := make([]string, 200)
+	for i := range buckets {
+		buckets[i] = "bucket." + strconv.Itoa(i)
+	}
+	return buckets
+}
+
+func TestShardedClient(t *testing.T) {
+	listeners := make([]*net.UDPConn, 3)
+	addrs := make([]string, len(listeners))
+	for i := range listeners {
+		listeners[i] = listenUDP(t)
+		defer listeners[i].Close()
+		addrs[i] = listeners[i].LocalAddr().String()
+	}
+
+	s, err := DialSharded(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetPrefix("app")
+
+	// send every bucket twice, both copies must end up on the same node
+	for round := 0; round < 2; round++ {
+		for _, bucket := range shardBuckets() {
+			err = s.Increment(bucket, 1, 1)
+			assert.Equal(t, err, nil)
+		}
+		err = s.Flush()
+		assert.Equal(t, err, nil)
+	}
+
+	seen := make(map[string]string)
+	for i, listener := range listeners {
+		lines := readLines(listener)
+		assert.T(t, len(lines) > 0, "node received no stats")
+		for _, line := range lines {
+			if node, ok := seen[line]; ok && node != addrs[i] {
+				t.Fatalf("%q was sent to %s and %s", line, node, addrs[i])
+			}
+			seen[line] = addrs[i]
+		}
+	}
+	for _, bucket := range shardBuckets() {
+		node, ok := seen["app."+bucket+":1|c"]
+		assert.T(t, ok, bucket+" was not received")
+		assert.Equal(t, s.nodeAddr(bucket), node)
+	}
+}
+
+func TestShardedClientRemapping(t *testing.T) {
+	s, err := DialSharded("127.0.0.1:8125", "127.0.0.1:8126", "127.0.0.1:8127")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	placement := func() map[string]string {
+		nodes := make(map[string]string)
+		for _, bucket := range shardBuckets() {
+			nodes[bucket] = s.nodeAddr(bucket)
+		}
+		return nodes
+	}
+	before := placement()
+
+	// adding a node only moves buckets to it
+	err = s.AddNode("127.0.0.1:8128")
+	assert.Equal(t, err, nil)
+	moved := 0
+	for bucket, node := range placement() {
+		if node != before[bucket] {
+			assert.Equal(t, "127.0.0.1:8128", node)
+			moved++
+		}
+	}
+	assert.T(t, moved > 0 && moved < len(before), "expected some buckets to move, got "+strconv.Itoa(moved))
+
+	// removing it puts them back where they were
+	err = s.RemoveNode("127.0.0.1:8128")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, before, placement())
+
+	// an unhealthy node's buckets fail over, everything else stays
+	err = s.SetHealthy("127.0.0.1:8126", false)
+	assert.Equal(t, err, nil)
+	for bucket, node := range placement() {
+		assert.NotEqual(t, "127.0.0.1:8126", node)
+		if before[bucket] != "127.0.0.1:8126" {
+			assert.Equal(t, before[bucket], node)
+		}
+	}
+	err = s.SetHealthy("127.0.0.1:8126", true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, before, placement())
+
+	assert.Equal(t, s.RemoveNode("127.0.0.1:9999"), errUnknownNode)
+}
+
+func TestShardedClientHealthCheck(t *testing.T) {
+	up := listenUDP(t)
+	defer up.Close()
+	// a port nobody listens on anymore
+	down := listenUDP(t)
+	downAddr := down.LocalAddr().String()
+	down.Close()
+
+	s, err := DialSharded(up.LocalAddr().String(), downAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetHealthCheck(5*time.Millisecond, probeUDP)
+
+	placedOn := func(addr string) bool {
+		for _, bucket := range shardBuckets() {
+			if s.nodeAddr(bucket) == addr {
+				return true
+			}
+		}
+		return false
+	}
+	for i := 0; placedOn(downAddr); i++ {
+		if i == 100 {
+			t.Fatal("the node that is down was never marked unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// it comes back once its check passes again
+	s.SetHealthCheck(5*time.Millisecond, func(addr string) error { return nil })
+	for i := 0; !placedOn(downAddr); i++ {
+		if i == 100 {
+			t.Fatal("the node never recovered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShardedClientSendErrors(t *testing.T) {
+	s, err := DialSharded("127.0.0.1:8125", "127.0.0.1:8126")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetHealthCheck(0, nil)
+
+	// stats the client refuses do not make the node unhealthy
+	addr := s.nodeAddr("bucket")
+	s.m.RLock()
+	node := s.nodes[addr]
+	s.m.RUnlock()
+	err = s.Increment(strings.Repeat("x", 600), 1, 1)
+	assert.Equal(t, ErrLineTooLong, err)
+	assert.Equal(t, addr, s.nodeAddr("bucket"))
+
+	// writes failing once the buffer fills up do
+	node.client.conn.Close()
+	err = nil
+	for i := 0; err == nil; i++ {
+		if i == 100 {
+			t.Fatal("the closed connection was never written to")
+		}
+		err = s.Increment("bucket", 1, 1)
+	}
+	assert.T(t, strings.HasPrefix(err.Error(), addr+": "), err.Error())
+	assert.NotEqual(t, addr, s.nodeAddr("bucket"))
+}
@@ -0,0 +1,83 @@
+package statsdclient
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// A Shutdowner can be shut down within a deadline, see Client.Shutdown.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// ShutdownError is returned by Shutdown when not every stat could be sent.
+type ShutdownError struct {
+	// Stats that were dropped
+	Abandoned int
+
+	// Packets left in the spool, they are sent once a client is dialed with the same spool directory
+	Spooled int
+
+	// The first error met while shutting down
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	msg := fmt.Sprintf("Shutdown abandoned %d stats and left %d packets in the spool", e.Abandoned, e.Spooled)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// add merges the result of shutting down another client into e.
+func (e *ShutdownError) add(err error) {
+	if err == nil {
+		return
+	}
+	if other, ok := err.(*ShutdownError); ok {
+		e.Abandoned += other.Abandoned
+		e.Spooled += other.Spooled
+		err = other.Err
+	}
+	if e.Err == nil {
+		e.Err = err
+	}
+}
+
+func (e *ShutdownError) orNil() error {
+	if e.Err == nil && e.Abandoned == 0 && e.Spooled == 0 {
+		return nil
+	}
+	return e
+}
+
+// ShutdownOnSignal shuts c down, allowing it timeout, once the process receives SIGTERM.
+// The result of Shutdown is sent on the returned channel. Cancelling ctx stops waiting for the
+// signal and closes the channel instead.
+func ShutdownOnSignal(ctx context.Context, c Shutdowner, timeout time.Duration) <-chan error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	done := make(chan error, 1)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			done <- c.Shutdown(shutdownCtx)
+		case <-ctx.Done():
+			close(done)
+		}
+	}()
+	return done
+}
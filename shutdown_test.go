@@ -0,0 +1,146 @@
+package statsdclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// brokenConn fails every write.
+type brokenConn struct {
+	flakyConn
+}
+
+func (b *brokenConn) Write(p []byte) (int, error) {
+	return 0, net.UnknownNetworkError("broken")
+}
+
+func TestShutdown(t *testing.T) {
+	c := NewMockClient()
+	err := c.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+
+	err = c.Shutdown(context.Background())
+	assert.Equal(t, err, nil)
+	stat, _ := c.NextStat()
+	assert.Equal(t, stat, "incr:1|c")
+
+	err = c.Increment("incr", 1, 1)
+	assert.Equal(t, err, ErrClosed)
+	err = c.Flush()
+	assert.Equal(t, err, ErrClosed)
+	err = c.Shutdown(context.Background())
+	assert.Equal(t, err, ErrClosed)
+}
+
+func TestShutdownAbandoned(t *testing.T) {
+	c := newClient(&brokenConn{}, 0)
+	for i := 0; i < 3; i++ {
+		err := c.Increment("incr", 1, 1)
+		assert.Equal(t, err, nil)
+	}
+
+	err := c.Shutdown(context.Background())
+	shutdownErr, ok := err.(*ShutdownError)
+	assert.T(t, ok, "expected a *ShutdownError")
+	assert.Equal(t, 3, shutdownErr.Abandoned)
+	assert.Equal(t, 0, shutdownErr.Spooled)
+}
+
+func TestShutdownSpoolDeadline(t *testing.T) {
+	conn, err := newSpoolConn(&brokenConn{}, SpoolConfig{Dir: t.TempDir(), RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(conn, 0)
+	c.Increment("incr", 1, 1)
+	c.Flush()
+	c.Increment("incr", 1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = c.Shutdown(ctx)
+	assert.T(t, errors.Is(err, context.DeadlineExceeded), "expected the deadline to pass")
+	assert.Equal(t, 2, err.(*ShutdownError).Spooled)
+	assert.Equal(t, 0, err.(*ShutdownError).Abandoned)
+}
+
+func TestShutdownStalledServer(t *testing.T) {
+	// a server that accepts connections but never reads from them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	c, err := DialConfig(Config{Addr: listener.Addr().String(), Network: "tcp", PacketSize: PacketSizeLoopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// send until the socket buffers are full and a write blocks
+	var sent int64
+	go func() {
+		for c.Increment("incr", 1, 1) != ErrClosed {
+			atomic.AddInt64(&sent, 1)
+		}
+	}()
+	conn := <-accepted
+	defer conn.Close()
+	for last := int64(-1); atomic.LoadInt64(&sent) != last; {
+		last = atomic.LoadInt64(&sent)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.Shutdown(ctx)
+	assert.NotEqual(t, nil, err)
+	assert.T(t, time.Since(start) < time.Second, "Shutdown was held up past its deadline")
+}
+
+func TestMultiClientShutdown(t *testing.T) {
+	first := NewMockClient()
+	m := Tee(first, NullStatsClient, newClient(&brokenConn{}, 0))
+	m.Increment("incr", 1, 1)
+
+	err := m.Shutdown(context.Background())
+	assert.Equal(t, 1, err.(*ShutdownError).Abandoned)
+	stat, _ := first.NextStat()
+	assert.Equal(t, stat, "incr:1|c")
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	c := NewMockClient()
+	done := ShutdownOnSignal(context.Background(), c, time.Second)
+
+	process, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil {
+		t.Skip("cannot send signals on this platform:", err)
+	}
+	assert.Equal(t, nil, <-done)
+	assert.Equal(t, ErrClosed, c.Increment("incr", 1, 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done = ShutdownOnSignal(ctx, c, time.Second)
+	cancel()
+	_, ok := <-done
+	assert.T(t, !ok, "expected the channel to be closed")
+}
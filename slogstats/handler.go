@@ -0,0 +1,284 @@
+// Package slogstats counts log records by level through a statsd client.
+//
+//	logger := slog.New(slogstats.NewHandler(slog.NewJSONHandler(os.Stderr, nil), client,
+//		slogstats.WithAttribute("component")))
+//
+// Every record handled increments "log.<level>", for example "log.info" or "log.error".
+// Records the inner handler fails to write also increment "log.dropped".
+package slogstats
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+)
+
+// Default bucket prefix
+const DefaultPrefix = "log"
+
+// An Option configures a Handler.
+type Option func(*Handler)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(h *Handler) { h.prefix = prefix }
+}
+
+// WithAttribute breaks the counts down by the value of the attribute key, for example "component",
+// whether it was added to the record or to the logger. When the client supports tags, see
+// statsdclient.Tagger, the value is sent as a "key:value" tag, and as a segment appended to the
+// bucket otherwise: "log.error.db". Attributes inside groups are named with their group, "req.method".
+func WithAttribute(key string) Option {
+	return func(h *Handler) { h.attribute = key }
+}
+
+// WithRateLimit sends at most perSecond stats a second, with bursts of as many.
+// The increments of records over the limit are carried over into the next stat sent to the same
+// bucket and tag, so counts stay right while a log storm cannot flood statsd. Increments still
+// carried over a second after the first of them are sent regardless of the limit, one stat per
+// bucket and tag. The handler must be closed once done logging, or the increments carried over
+// during the last second are lost.
+func WithRateLimit(perSecond int) Option {
+	return func(h *Handler) { h.limiter = newLimiter(perSecond) }
+}
+
+// A Handler passes records to an inner slog.Handler and counts them.
+type Handler struct {
+	inner     slog.Handler
+	client    statsdclient.StatsClient
+	prefix    string
+	attribute string
+	limiter   *limiter
+
+	// The groups opened with WithGroup, "a.b."
+	groups string
+	// The value of the attribute added with WithAttrs, if any
+	value string
+}
+
+// NewHandler returns a handler passing records to inner and counting them through client.
+// With WithRateLimit, Close is required once done logging, see WithRateLimit.
+func NewHandler(inner slog.Handler, client statsdclient.StatsClient, opts ...Option) *Handler {
+	h := &Handler{
+		inner:  inner,
+		client: client,
+		prefix: DefaultPrefix,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.prefix != "" {
+		h.prefix += "."
+	}
+	return h
+}
+
+// Close sends the increments carried over by the rate limit. It does nothing without WithRateLimit.
+// The handler, and those derived from it with WithAttrs and WithGroup, should not be used afterwards.
+func (h *Handler) Close() error {
+	if h.limiter != nil {
+		h.limiter.close()
+	}
+	return nil
+}
+
+// Enabled reports whether the inner handler handles records at level.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+// Handle counts r and passes it to the inner handler, returning its error.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	err := h.inner.Handle(ctx, r)
+
+	value := h.value
+	if h.attribute != "" {
+		r.Attrs(func(attr slog.Attr) bool {
+			if v, ok := h.find(h.groups, attr); ok {
+				value = v
+				return false
+			}
+			return true
+		})
+	}
+
+	client, bucket, tag := h.client, h.prefix+levelSegment(r.Level), ""
+	if value != "" {
+		var tagged bool
+		if client, tagged = statsdclient.WithTags(h.client, h.attribute+":"+value); tagged {
+			tag = h.attribute + ":" + value
+		} else {
+			bucket += "." + statsdclient.SanitizeSegment(value)
+		}
+	}
+	h.increment(client, bucket, tag)
+	if err != nil {
+		h.increment(h.client, h.prefix+"dropped", "")
+	}
+	return err
+}
+
+// WithAttrs returns a handler adding attrs to the records, see slog.Handler.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithAttrs(attrs)
+	if h.attribute != "" {
+		for _, attr := range attrs {
+			if v, ok := h.find(h.groups, attr); ok {
+				clone.value = v
+			}
+		}
+	}
+	return &clone
+}
+
+// WithGroup returns a handler putting the attributes that follow in a group, see slog.Handler.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.inner = h.inner.WithGroup(name)
+	if name != "" {
+		clone.groups += name + "."
+	}
+	return &clone
+}
+
+// find returns the value of the chosen attribute when attr, in groups, is it or contains it.
+func (h *Handler) find(groups string, attr slog.Attr) (string, bool) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			groups += attr.Key + "."
+		}
+		for _, a := range attr.Value.Group() {
+			if v, ok := h.find(groups, a); ok {
+				return v, true
+			}
+		}
+		return "", false
+	}
+	if groups+attr.Key != h.attribute {
+		return "", false
+	}
+	return attr.Value.String(), true
+}
+
+func (h *Handler) increment(client statsdclient.StatsClient, bucket, tag string) {
+	count := 1
+	if h.limiter != nil {
+		var ok bool
+		if count, ok = h.limiter.take(limitKey{bucket, tag}, client); !ok {
+			return
+		}
+	}
+	client.Increment(bucket, count, 1)
+}
+
+// levelSegment names the standard levels "debug", "info", "warn" and "error",
+// and the others after the closest one below them: "warn_2" for slog.LevelWarn+2.
+func levelSegment(level slog.Level) string {
+	return statsdclient.SanitizeSegment(strings.Replace(strings.ToLower(level.String()), "+", "_", 1))
+}
+
+// How long the increments carried over by the rate limit wait at most to be sent
+var deferredInterval = time.Second
+
+// limiter is a token bucket, keeping the counts of the stats it did not let through.
+type limiter struct {
+	m        sync.Mutex
+	rate     float64
+	tokens   float64
+	last     time.Time
+	deferred map[limitKey]*deferredCount
+	now      func() time.Time
+
+	// Flushes the counts carried over, pending only while there are some, so that a handler
+	// that is never closed leaves nothing running
+	timer *time.Timer
+	// Tracks the flush of the timer, if pending or running
+	flushing sync.WaitGroup
+	closed   bool
+}
+
+// The bucket and tag a stat is sent to
+type limitKey struct {
+	bucket, tag string
+}
+
+// The increments carried over for a bucket and tag, and the client sending them with the tag
+type deferredCount struct {
+	client statsdclient.StatsClient
+	count  int
+}
+
+func newLimiter(perSecond int) *limiter {
+	return &limiter{
+		rate:     float64(perSecond),
+		tokens:   float64(perSecond),
+		last:     time.Now(),
+		deferred: map[limitKey]*deferredCount{},
+		now:      time.Now,
+	}
+}
+
+// take returns the count to send to key, if a stat may be sent now. Otherwise the increment is
+// carried over, and sent through client by flush if no stat for key is let through before.
+func (l *limiter) take(key limitKey, client statsdclient.StatsClient) (int, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := l.now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens < 1 {
+		if d := l.deferred[key]; d != nil {
+			d.count++
+		} else {
+			l.deferred[key] = &deferredCount{client: client, count: 1}
+		}
+		if l.timer == nil && !l.closed {
+			l.flushing.Add(1)
+			l.timer = time.AfterFunc(deferredInterval, func() {
+				defer l.flushing.Done()
+				l.flush()
+			})
+		}
+		return 0, false
+	}
+	l.tokens--
+	count := 1
+	if d := l.deferred[key]; d != nil {
+		count += d.count
+		delete(l.deferred, key)
+	}
+	return count, true
+}
+
+// flush sends the increments carried over.
+func (l *limiter) flush() {
+	l.m.Lock()
+	deferred := l.deferred
+	l.deferred = map[limitKey]*deferredCount{}
+	l.timer = nil
+	l.m.Unlock()
+
+	for key, d := range deferred {
+		d.client.Increment(key.bucket, d.count, 1)
+	}
+}
+
+// close stops the timer, waits for a flush in progress, and sends what is left.
+func (l *limiter) close() {
+	l.m.Lock()
+	l.closed = true
+	if l.timer != nil && l.timer.Stop() {
+		l.flushing.Done()
+	}
+	l.m.Unlock()
+
+	l.flushing.Wait()
+	l.flush()
+}
@@ -0,0 +1,226 @@
+package slogstats
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sort"
+	"strings"
+	"testing"
+	"testing/slogtest"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+func lines(metrics []statsdproto.Metric) string {
+	var lines []string
+	for _, m := range metrics {
+		lines = append(lines, m.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	client := statsdclienttest.NewStatsClient()
+	logger := slog.New(NewHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}), client))
+
+	logger.Debug("not enabled")
+	logger.Info("hello")
+	logger.Warn("careful")
+	logger.Error("oops")
+	logger.Log(context.Background(), slog.LevelWarn+2, "custom")
+
+	expected := "log.info:1|c\nlog.warn:1|c\nlog.error:1|c\nlog.warn_2:1|c"
+	if got := lines(client.Metrics()); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+	if !strings.Contains(buf.String(), "msg=hello") || strings.Contains(buf.String(), "not enabled") {
+		t.Errorf("records were not passed through:\n%s", buf.String())
+	}
+}
+
+func TestHandlerAttributeSegment(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	logger := slog.New(NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithPrefix("app.log"), WithAttribute("component")))
+
+	logger.Info("no component")
+	logger.Info("record", "component", "db")
+	logger.With("component", "api.v1").Error("logger")
+	logger.With("component", "api").Info("record wins", "component", "cache")
+	logger.WithGroup("req").Info("in a group", "component", "ignored")
+	logger.Info("group attr", slog.Group("", slog.String("component", "inline")))
+
+	expected := strings.Join([]string{
+		"app.log.info:1|c",
+		"app.log.info.db:1|c",
+		"app.log.error.api_v1:1|c",
+		"app.log.info.cache:1|c",
+		"app.log.info:1|c",
+		"app.log.info.inline:1|c",
+	}, "\n")
+	if got := lines(client.Metrics()); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHandlerAttributeGroups(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	logger := slog.New(NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithAttribute("req.method")))
+
+	logger.WithGroup("req").Info("a", "method", "GET")
+	logger.Info("b", slog.Group("req", "method", "POST"))
+
+	expected := "log.info.GET:1|c\nlog.info.POST:1|c"
+	if got := lines(client.Metrics()); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHandlerAttributeTag(t *testing.T) {
+	client := statsdclient.NewMockClient()
+	logger := slog.New(NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithAttribute("component")))
+	logger.Warn("tagged", "component", "db")
+
+	stat, _ := client.NextStat()
+	if stat != "log.warn:1|c|#component:db" {
+		t.Errorf("unexpected stat %q", stat)
+	}
+}
+
+type failingHandler struct {
+	slog.Handler
+}
+
+func (failingHandler) Handle(context.Context, slog.Record) error {
+	return errors.New("disk full")
+}
+
+func TestHandlerDropped(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	h := NewHandler(failingHandler{slog.NewTextHandler(&bytes.Buffer{}, nil)}, client)
+	if err := slog.New(h).Handler().Handle(context.Background(), slog.NewRecord(time.Now(), slog.LevelInfo, "lost", 0)); err == nil {
+		t.Error("expected the error of the inner handler")
+	}
+
+	expected := "log.info:1|c\nlog.dropped:1|c"
+	if got := lines(client.Metrics()); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	h := NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithRateLimit(2))
+	defer h.Close()
+	now := time.Now()
+	h.limiter.now = func() time.Time { return now }
+	h.limiter.last = now
+	logger := slog.New(h)
+
+	for i := 0; i < 10; i++ {
+		logger.Info("storm")
+	}
+	if got := lines(client.Metrics()); got != "log.info:1|c\nlog.info:1|c" {
+		t.Fatalf("expected the burst only, got:\n%s", got)
+	}
+
+	// half a second later, a token is back and the suppressed records are counted
+	now = now.Add(500 * time.Millisecond)
+	logger.Info("storm")
+	metrics := client.Metrics()
+	if last := metrics[len(metrics)-1].String(); last != "log.info:9|c" {
+		t.Errorf("expected the deferred records to be counted, got %s", last)
+	}
+}
+
+func TestHandlerRateLimitTags(t *testing.T) {
+	client := statsdclient.NewMockClient()
+	h := NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithAttribute("component"), WithRateLimit(1))
+	now := time.Now()
+	h.limiter.now = func() time.Time { return now }
+	h.limiter.last = now
+	logger := slog.New(h)
+
+	logger.Error("storm", "component", "db")
+	for i := 0; i < 5; i++ {
+		logger.Error("storm", "component", "db")
+	}
+	logger.Error("storm", "component", "cache")
+
+	// the next token goes to another tag, which does not get the suppressed records of db
+	now = now.Add(time.Second)
+	logger.Error("calm", "component", "api")
+	h.Close()
+
+	var stats []string
+	for {
+		stat, err := client.NextStat()
+		if err != nil {
+			break
+		}
+		stats = append(stats, stat)
+	}
+	sort.Strings(stats[2:])
+	expected := []string{
+		"log.error:1|c|#component:db",
+		"log.error:1|c|#component:api",
+		"log.error:1|c|#component:cache",
+		"log.error:5|c|#component:db",
+	}
+	if strings.Join(stats, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("got:\n%s\nexpected:\n%s", strings.Join(stats, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestHandlerRateLimitFlush(t *testing.T) {
+	defer func(interval time.Duration) { deferredInterval = interval }(deferredInterval)
+	deferredInterval = 5 * time.Millisecond
+	client := statsdclienttest.NewStatsClient()
+	h := NewHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), client, WithRateLimit(1))
+	defer h.Close()
+
+	logger := slog.New(h)
+	for i := 0; i < 4; i++ {
+		logger.Warn("storm")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(client.Metrics()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := lines(client.Metrics()); got != "log.warn:1|c\nlog.warn:3|c" {
+		t.Errorf("expected the deferred records to be sent without another record, got:\n%s", got)
+	}
+
+	// nothing is left running once the deferred records are sent, closed or not
+	h.limiter.m.Lock()
+	pending := h.limiter.timer != nil
+	h.limiter.m.Unlock()
+	if pending {
+		t.Error("expected no timer without deferred records")
+	}
+}
+
+func TestHandlerConformance(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewHandler(slog.NewJSONHandler(&buf, nil), statsdclient.NullStatsClient, WithAttribute("a"))
+	results := func() []map[string]any {
+		var records []map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n")) {
+			var record map[string]any
+			if err := json.Unmarshal(line, &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+	if err := slogtest.TestHandler(h, results); err != nil {
+		t.Error(err)
+	}
+}
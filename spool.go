@@ -0,0 +1,610 @@
+package statsdclient
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpoolMaxBytes      = 64 << 20
+	defaultSpoolSegmentSize   = 1 << 20
+	defaultSpoolRetryInterval = time.Second
+
+	// How many packets are read from the spool at a time to be sent again
+	spoolBatchSize = 64
+
+	// How many bytes can be appended before they are synced to disk, they are synced after
+	// every retry too
+	spoolSyncBytes = 64 << 10
+
+	// Every record starts with the payload length, a checksum and the time it was spooled
+	spoolHeaderSize = 16
+
+	spoolSegmentExt = ".seg"
+	spoolCursorFile = "cursor"
+)
+
+// SpoolConfig holds the settings of the on-disk spool, see Config.Spool.
+type SpoolConfig struct {
+	// The directory holding the spool. Only one client may use a directory at a time.
+	Dir string
+
+	// The most bytes kept on disk, the oldest packets are dropped to stay under it. Defaults to 64MiB.
+	MaxBytes int64
+
+	// Packets spooled longer ago than this are dropped instead of sent. Zero keeps them until MaxBytes is reached.
+	MaxAge time.Duration
+
+	// The size at which a new segment file is started. Defaults to 1MiB.
+	SegmentSize int64
+
+	// How often sending the spooled packets is retried. Defaults to 1 second.
+	RetryInterval time.Duration
+
+	// When set, the state of the spool is sent through the client every RetryInterval, as the gauges
+	// <StatsBucket>.packets, <StatsBucket>.bytes and <StatsBucket>.dropped, see SpoolStats.
+	StatsBucket string
+}
+
+// SpoolStats describes the state of the spool.
+type SpoolStats struct {
+	// Packets waiting to be sent
+	Packets int
+
+	// Bytes taken on disk
+	Bytes int64
+
+	// Packets dropped because of MaxBytes or MaxAge since the client was dialed
+	Dropped int
+}
+
+type spoolSegment struct {
+	seq  int64
+	size int64
+
+	// Packets in the segment that have not been sent yet
+	packets int
+}
+
+// spool is an append-only log of packets, split over numbered segment files in a directory.
+// The cursor file records how much of the oldest segment has been sent, so that packets are not
+// sent again after a restart. A record torn by a crash is cut off when the spool is opened.
+// Packets are sent at least once: the cursor moves once per batch, so a crash while sending one
+// sends it again. Appends are synced to disk every spoolSyncBytes and after every retry, a crash
+// loses those that were not.
+type spool struct {
+	cfg SpoolConfig
+
+	// Oldest first. The newest is open for appending in active, the oldest for reading in head.
+	segments []*spoolSegment
+	active   *os.File
+	head     *os.File
+	headSeq  int64
+	nextSeq  int64
+
+	// How far the oldest segment has been sent
+	offset int64
+
+	packets int
+	bytes   int64
+	dropped int
+
+	// Bytes appended to active since it was last synced
+	unsynced int64
+}
+
+// A packet read from the spool, with when it was spooled and the size of its record
+type spoolRecord struct {
+	p       []byte
+	spooled time.Time
+	size    int64
+}
+
+// Where a batch of records starts: the segment and the offset in it
+type spoolPosition struct {
+	seq, offset int64
+}
+
+var errSpoolCorrupt = errors.New("Spool record is corrupt")
+
+func openSpool(cfg SpoolConfig) (*spool, error) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultSpoolMaxBytes
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSpoolSegmentSize
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &spool{cfg: cfg}
+	cursorSeq, cursorOffset := s.readCursor()
+	s.nextSeq = cursorSeq + 1
+
+	names, err := filepath.Glob(filepath.Join(cfg.Dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(name), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq < cursorSeq {
+			// fully sent before the restart
+			os.Remove(name)
+			continue
+		}
+
+		from := int64(0)
+		if seq == cursorSeq {
+			from = cursorOffset
+		}
+		seg, start, err := recoverSegment(name, seq, from)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.segments) == 0 {
+			s.offset = start
+		}
+		s.segments = append(s.segments, seg)
+		s.packets += seg.packets
+		s.bytes += seg.size
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+	}
+	return s, nil
+}
+
+// recoverSegment checks every record of a segment file, cutting it off at the first torn or corrupt one.
+// It returns the segment with the packets at or after from, and where the first of those starts.
+func recoverSegment(name string, seq, from int64) (*spoolSegment, int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	seg := &spoolSegment{seq: seq}
+	start := int64(-1)
+	for seg.size+spoolHeaderSize <= int64(len(data)) {
+		header := data[seg.size : seg.size+spoolHeaderSize]
+		end := seg.size + spoolHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if end > int64(len(data)) || crc32.ChecksumIEEE(data[seg.size+8:end]) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		if seg.size >= from {
+			if start < 0 {
+				start = seg.size
+			}
+			seg.packets++
+		}
+		seg.size = end
+	}
+	if start < 0 {
+		start = seg.size
+	}
+
+	if seg.size < int64(len(data)) {
+		if err := os.Truncate(name, seg.size); err != nil {
+			return nil, 0, err
+		}
+	}
+	return seg, start, nil
+}
+
+func (s *spool) segmentName(seq int64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+func (s *spool) readCursor() (int64, int64) {
+	var seq, offset int64
+	data, err := os.ReadFile(filepath.Join(s.cfg.Dir, spoolCursorFile))
+	if err == nil {
+		fmt.Sscan(string(data), &seq, &offset)
+	}
+	return seq, offset
+}
+
+// writeCursor records how far the oldest segment has been sent, replacing the cursor file atomically.
+func (s *spool) writeCursor() error {
+	name := filepath.Join(s.cfg.Dir, spoolCursorFile)
+	data := fmt.Sprintf("%d %d\n", s.segments[0].seq, s.offset)
+	if err := os.WriteFile(name+".tmp", []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// append adds p to the end of the spool, dropping the oldest segments if it would grow past MaxBytes.
+func (s *spool) append(p []byte, now time.Time) error {
+	size := int64(spoolHeaderSize + len(p))
+	if s.bytes+size > s.cfg.MaxBytes {
+		// never drop the segment being appended to
+		s.closeActive()
+		for len(s.segments) > 0 && s.bytes+size > s.cfg.MaxBytes {
+			s.removeHead()
+		}
+	}
+
+	if s.active == nil || s.segments[len(s.segments)-1].size+size > s.cfg.SegmentSize {
+		if err := s.startSegment(); err != nil {
+			return err
+		}
+	}
+	seg := s.segments[len(s.segments)-1]
+
+	record := make([]byte, size)
+	binary.BigEndian.PutUint32(record, uint32(len(p)))
+	binary.BigEndian.PutUint64(record[8:], uint64(now.UnixNano()))
+	copy(record[spoolHeaderSize:], p)
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(record[8:]))
+
+	if _, err := s.active.Write(record); err != nil {
+		// do not leave a torn record in front of the next one
+		s.active.Truncate(seg.size)
+		return err
+	}
+
+	seg.size += size
+	seg.packets++
+	s.packets++
+	s.bytes += size
+	s.unsynced += size
+	if s.unsynced >= spoolSyncBytes {
+		return s.sync()
+	}
+	return nil
+}
+
+// sync writes what was appended to the active segment to disk.
+func (s *spool) sync() error {
+	if s.active == nil || s.unsynced == 0 {
+		return nil
+	}
+	s.unsynced = 0
+	return s.active.Sync()
+}
+
+func (s *spool) startSegment() error {
+	s.closeActive()
+	f, err := os.OpenFile(s.segmentName(s.nextSeq), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	if len(s.segments) == 0 {
+		s.offset = 0
+	}
+	s.segments = append(s.segments, &spoolSegment{seq: s.nextSeq})
+	s.nextSeq++
+	return nil
+}
+
+func (s *spool) closeActive() {
+	if s.active != nil {
+		s.sync()
+		s.active.Close()
+		s.active = nil
+	}
+}
+
+// removeHead deletes the oldest segment, dropping whatever it still holds.
+func (s *spool) removeHead() {
+	seg := s.segments[0]
+	if len(s.segments) == 1 {
+		s.closeActive()
+	}
+	if s.head != nil {
+		s.head.Close()
+		s.head = nil
+	}
+	os.Remove(s.segmentName(seg.seq))
+
+	s.dropped += seg.packets
+	s.packets -= seg.packets
+	s.bytes -= seg.size
+	s.segments = s.segments[1:]
+	s.offset = 0
+}
+
+// peek returns up to max of the oldest packets of the oldest segment, and where they start.
+func (s *spool) peek(max int) ([]spoolRecord, spoolPosition, error) {
+	for len(s.segments) > 1 && s.offset >= s.segments[0].size {
+		s.removeHead()
+	}
+	if len(s.segments) == 0 || s.offset >= s.segments[0].size {
+		return nil, spoolPosition{}, io.EOF
+	}
+
+	seg := s.segments[0]
+	pos := spoolPosition{seg.seq, s.offset}
+	if s.head == nil || s.headSeq != seg.seq {
+		if s.head != nil {
+			s.head.Close()
+		}
+		f, err := os.Open(s.segmentName(seg.seq))
+		if err != nil {
+			return nil, pos, err
+		}
+		s.head = f
+		s.headSeq = seg.seq
+	}
+
+	var records []spoolRecord
+	for offset := s.offset; len(records) < max && offset < seg.size; {
+		header := make([]byte, spoolHeaderSize)
+		if _, err := s.head.ReadAt(header, offset); err != nil {
+			return records, pos, err
+		}
+		record := make([]byte, 8+binary.BigEndian.Uint32(header))
+		copy(record, header[8:])
+		if _, err := s.head.ReadAt(record[8:], offset+spoolHeaderSize); err != nil {
+			return records, pos, err
+		}
+		if crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:]) {
+			if len(records) > 0 {
+				// send what comes before it first
+				return records, pos, nil
+			}
+			// nothing after a corrupt record can be trusted, give up on the rest of the segment
+			s.dropped += seg.packets
+			s.packets -= seg.packets
+			seg.packets = 0
+			s.offset = seg.size
+			return nil, pos, errSpoolCorrupt
+		}
+
+		size := spoolHeaderSize + int64(len(record)) - 8
+		spooled := time.Unix(0, int64(binary.BigEndian.Uint64(record)))
+		records = append(records, spoolRecord{record[8:], spooled, size})
+		offset += size
+	}
+	return records, pos, nil
+}
+
+// advance moves past records, the first ones peeked at pos, of which dropped were dropped
+// instead of sent, and records the new position in the cursor file. Nothing moves when the
+// segment they were in was dropped since they were peeked.
+func (s *spool) advance(pos spoolPosition, records []spoolRecord, dropped int) error {
+	if len(records) == 0 || len(s.segments) == 0 || s.segments[0].seq != pos.seq || s.offset != pos.offset {
+		return nil
+	}
+	for _, r := range records {
+		s.offset += r.size
+	}
+	s.segments[0].packets -= len(records)
+	s.packets -= len(records)
+	s.dropped += dropped
+
+	if s.packets == 0 {
+		// everything has been sent, start over with an empty directory
+		for len(s.segments) > 0 {
+			s.removeHead()
+		}
+		return nil
+	}
+	return s.writeCursor()
+}
+
+func (s *spool) close() error {
+	s.closeActive()
+	if s.head != nil {
+		s.head.Close()
+		s.head = nil
+	}
+	return nil
+}
+
+// spoolConn spools the packets its connection fails to send, and sends them again in the background.
+// While the spool holds packets new ones are spooled behind them, so that they are sent in order.
+// Spooled packets are sent in batches without holding m, so that writes only wait for the spool
+// to be read or appended to, never for the connection.
+type spoolConn struct {
+	statsdConn
+
+	m        sync.Mutex
+	spool    *spool
+	// Held while sending spooled packets, so that they are sent once
+	replayM  sync.Mutex
+	maxAge   time.Duration
+	interval time.Duration
+
+	// Called with the state of the spool after every retry, without s.m held
+	report func(SpoolStats)
+
+	// Cancelled by Close, to stop retrying
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+}
+
+func newSpoolConn(conn statsdConn, cfg SpoolConfig) (*spoolConn, error) {
+	spool, err := openSpool(cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	interval := cfg.RetryInterval
+	if interval <= 0 {
+		interval = defaultSpoolRetryInterval
+	}
+
+	s := &spoolConn{
+		statsdConn: conn,
+		spool:      spool,
+		maxAge:     cfg.MaxAge,
+		interval:   interval,
+		stopped:    make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	go s.retry(interval)
+	return s, nil
+}
+
+func (s *spoolConn) retry(interval time.Duration) {
+	defer close(s.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+		s.replay(s.ctx)
+		s.m.Lock()
+		s.spool.sync()
+		report := s.report
+		stats := s.statsLocked()
+		s.m.Unlock()
+		if report != nil {
+			report(stats)
+		}
+	}
+}
+
+// setReport sets the function called with the state of the spool after every retry.
+func (s *spoolConn) setReport(report func(SpoolStats)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.report = report
+}
+
+// replay sends spooled packets until the spool is empty, sending fails or ctx is done.
+func (s *spoolConn) replay(ctx context.Context) error {
+	s.replayM.Lock()
+	defer s.replayM.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.m.Lock()
+		records, pos, err := s.spool.peek(spoolBatchSize)
+		s.m.Unlock()
+		if err == errSpoolCorrupt {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		done, dropped := 0, 0
+		for _, r := range records {
+			if err = ctx.Err(); err != nil {
+				break
+			}
+			if s.maxAge > 0 && time.Since(r.spooled) > s.maxAge {
+				dropped++
+			} else if _, err = s.statsdConn.Write(r.p); err != nil {
+				break
+			}
+			done++
+		}
+
+		s.m.Lock()
+		advanceErr := s.spool.advance(pos, records[:done], dropped)
+		s.m.Unlock()
+		if err != nil {
+			return err
+		}
+		if advanceErr != nil {
+			return advanceErr
+		}
+	}
+}
+
+// Write sends p, or spools it when the connection fails or packets are spooled already.
+func (s *spoolConn) Write(p []byte) (int, error) {
+	s.m.Lock()
+	empty := s.spool.packets == 0
+	s.m.Unlock()
+	if empty {
+		if n, err := s.statsdConn.Write(p); err == nil {
+			return n, nil
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := s.spool.append(p, time.Now()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// direct returns a connection writing to the connection of s without ever spooling,
+// dropping what it fails to send.
+func (s *spoolConn) direct() io.WriteCloser {
+	return nopCloser{s.statsdConn}
+}
+
+// drain keeps sending spooled packets until the spool is empty or ctx is done,
+// and returns how many packets are left.
+func (s *spoolConn) drain(ctx context.Context) (int, error) {
+	for {
+		s.replay(ctx)
+		s.m.Lock()
+		left := s.spool.packets
+		s.m.Unlock()
+		if left == 0 {
+			return 0, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return left, ctx.Err()
+		case <-time.After(s.interval):
+		}
+	}
+}
+
+func (s *spoolConn) stats() SpoolStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.statsLocked()
+}
+
+// statsLocked returns the state of the spool. Must be called with s.m held.
+func (s *spoolConn) statsLocked() SpoolStats {
+	return SpoolStats{
+		Packets: s.spool.packets,
+		Bytes:   s.spool.bytes,
+		Dropped: s.spool.dropped,
+	}
+}
+
+// SetWriteDeadline sets the deadline of the writes to the connection, if it supports one.
+func (s *spoolConn) SetWriteDeadline(deadline time.Time) error {
+	if d, ok := s.statsdConn.(writeDeadliner); ok {
+		return d.SetWriteDeadline(deadline)
+	}
+	return nil
+}
+
+// Close stops retrying and closes the connection. Packets still in the spool are sent after
+// the next client using the same directory is dialed.
+func (s *spoolConn) Close() error {
+	s.cancel()
+	<-s.stopped
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.spool.close()
+	return s.statsdConn.Close()
+}
@@ -0,0 +1,377 @@
+package statsdclient
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// flakyConn records the packets written to it, and fails every write while it is down.
+type flakyConn struct {
+	down    bool
+	packets []string
+}
+
+func (f *flakyConn) Write(p []byte) (int, error) {
+	if f.down {
+		return 0, net.UnknownNetworkError("down")
+	}
+	f.packets = append(f.packets, string(p))
+	return len(p), nil
+}
+
+func (f *flakyConn) Close() error {
+	return nil
+}
+
+func (f *flakyConn) remoteIP() net.IP {
+	return net.IPv4(127, 0, 0, 1)
+}
+
+func TestSpoolRecovery(t *testing.T) {
+	cfg := SpoolConfig{Dir: t.TempDir(), SegmentSize: 64}
+	s, err := openSpool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		err = s.append([]byte("packet:"+strconv.Itoa(i)+"|c"), time.Now())
+		assert.Equal(t, err, nil)
+	}
+	records, pos, err := s.peek(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, "packet:0|c", string(records[0].p))
+	err = s.advance(pos, records, 0)
+	assert.Equal(t, err, nil)
+	s.close()
+
+	// a crash in the middle of a write leaves part of a record behind
+	names, _ := filepath.Glob(filepath.Join(cfg.Dir, "*.seg"))
+	f, err := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 42, 1, 2})
+	f.Close()
+
+	s, err = openSpool(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	assert.Equal(t, 3, s.packets)
+	for i := 1; i < 4; i++ {
+		records, pos, err := s.peek(spoolBatchSize)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, "packet:"+strconv.Itoa(i)+"|c", string(records[0].p))
+		s.advance(pos, records[:1], 0)
+	}
+	assert.Equal(t, 0, s.packets)
+	names, _ = filepath.Glob(filepath.Join(cfg.Dir, "*.seg"))
+	assert.Equal(t, 0, len(names))
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	// every record is 16 bytes of header and 10 of packet
+	s, err := openSpool(SpoolConfig{Dir: t.TempDir(), SegmentSize: 52, MaxBytes: 104})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	for i := 0; i < 10; i++ {
+		s.append([]byte("packet:"+strconv.Itoa(i)+"|c"), time.Now())
+	}
+	assert.T(t, s.bytes <= 104, "spool grew past MaxBytes")
+	assert.Equal(t, 6, s.dropped)
+	assert.Equal(t, 4, s.packets)
+	records, pos, _ := s.peek(spoolBatchSize)
+	assert.Equal(t, "packet:6|c", string(records[0].p))
+
+	// a segment dropped while its packets were being sent is not moved past twice
+	s.append([]byte("packet:a|c"), time.Now())
+	s.append([]byte("packet:b|c"), time.Now())
+	assert.Equal(t, nil, s.advance(pos, records, 0))
+	assert.Equal(t, 4, s.packets)
+	records, _, _ = s.peek(spoolBatchSize)
+	assert.Equal(t, "packet:8|c", string(records[0].p))
+}
+
+func TestSpoolConn(t *testing.T) {
+	conn := &flakyConn{down: true}
+	s, err := newSpoolConn(conn, SpoolConfig{Dir: t.TempDir(), MaxAge: time.Minute, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Write([]byte("old:1|c"))
+	s.spool.append([]byte("too.old:1|c"), time.Now().Add(-time.Hour))
+	s.Write([]byte("new:1|c"))
+	assert.Equal(t, SpoolStats{Packets: 3, Bytes: 3*spoolHeaderSize + 25}, s.stats())
+
+	// packets stay in order behind the spool even once the server is back
+	conn.down = false
+	s.Write([]byte("newest:1|c"))
+	assert.Equal(t, 0, len(conn.packets))
+
+	// a done context stops replaying
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = s.replay(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, len(conn.packets))
+
+	err = s.replay(context.Background())
+	assert.Equal(t, err, nil)
+	assert.Equal(t, []string{"old:1|c", "new:1|c", "newest:1|c"}, conn.packets)
+	assert.Equal(t, SpoolStats{Dropped: 1}, s.stats())
+}
+
+// stallingConn blocks every write until released.
+type stallingConn struct {
+	flakyConn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (s *stallingConn) Write(p []byte) (int, error) {
+	s.writing <- struct{}{}
+	<-s.release
+	return s.flakyConn.Write(p)
+}
+
+func TestSpoolConnStalled(t *testing.T) {
+	conn := &stallingConn{writing: make(chan struct{}, 10), release: make(chan struct{})}
+	s, err := newSpoolConn(conn, SpoolConfig{Dir: t.TempDir(), RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.spool.append([]byte("old:1|c"), time.Now())
+
+	replayed := make(chan error)
+	go func() { replayed <- s.replay(context.Background()) }()
+	<-conn.writing
+
+	// writes are spooled while the connection is stalled, without waiting for it
+	written := make(chan struct{})
+	go func() {
+		s.Write([]byte("new:1|c"))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("a write waited for the stalled connection")
+	}
+
+	close(conn.release)
+	assert.Equal(t, nil, <-replayed)
+	assert.Equal(t, []string{"old:1|c", "new:1|c"}, conn.packets)
+	assert.Equal(t, nil, s.Close())
+}
+
+// tcpServer collects the lines sent to it, and can be stopped and started again on the same address.
+type tcpServer struct {
+	addr     string
+	m        sync.Mutex
+	listener net.Listener
+	conns    []net.Conn
+	lines    []string
+}
+
+func (s *tcpServer) start(t *testing.T) {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = listener.Addr().String()
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.m.Lock()
+			s.conns = append(s.conns, conn)
+			s.m.Unlock()
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.m.Lock()
+					s.lines = append(s.lines, scanner.Text())
+					s.m.Unlock()
+				}
+			}()
+		}
+	}()
+}
+
+func (s *tcpServer) stop() {
+	s.listener.Close()
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *tcpServer) received() []string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]string(nil), s.lines...)
+}
+
+func TestSpoolFlakyServer(t *testing.T) {
+	server := &tcpServer{addr: "127.0.0.1:0"}
+	server.start(t)
+	defer server.stop()
+
+	c, err := DialConfig(Config{
+		Addr:    server.addr,
+		Network: "tcp",
+		Spool:   &SpoolConfig{Dir: t.TempDir(), RetryInterval: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Increment("before", 1, 1)
+	c.Flush()
+	for i := 0; len(server.received()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("server did not receive the first stat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// stats sent once the server closed the connection are spooled, none are lost
+	server.stop()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		c.Gauge("gauge", i, 1)
+		c.Flush()
+	}
+	assert.Equal(t, 5, c.SpoolStats().Packets)
+
+	server.start(t)
+	for i := 0; c.SpoolStats().Packets > 0; i++ {
+		if i == 100 {
+			t.Fatal("spool was not replayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expected := []string{"before:1|c"}
+	for i := 0; i < 5; i++ {
+		expected = append(expected, "gauge:"+strconv.Itoa(i)+"|g")
+	}
+	for i := 0; len(server.received()) < len(expected); i++ {
+		if i == 100 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, expected, server.received())
+}
+
+func TestSpoolStatsBucket(t *testing.T) {
+	server := listenUDP(t)
+	defer server.Close()
+	dir := t.TempDir()
+
+	// a spooled packet left behind by a previous client
+	s, err := openSpool(SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.append([]byte("old:1|c"), time.Now())
+	s.close()
+
+	c, err := DialConfig(Config{
+		Addr:  server.LocalAddr().String(),
+		Spool: &SpoolConfig{Dir: dir, RetryInterval: 10 * time.Millisecond, StatsBucket: "statsd.spool."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	lines := map[string]bool{}
+	buf := make([]byte, PacketSizeLoopback)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for !lines["statsd.spool.packets:0|g"] {
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatalf("spool stats were not sent, got %v", lines)
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			lines[line] = true
+		}
+	}
+	assert.T(t, lines["old:1|c"], "the spooled packet was not sent")
+	assert.T(t, lines["statsd.spool.bytes:0|g"], "spool bytes were not sent")
+	assert.T(t, lines["statsd.spool.dropped:0|g"], "spool drops were not sent")
+}
+
+func TestSpoolStatsNotSpooled(t *testing.T) {
+	server := &tcpServer{addr: "127.0.0.1:0"}
+	server.start(t)
+	server.stop()
+
+	c, err := DialConfig(Config{
+		Addr:    server.addr,
+		Network: "tcp",
+		Spool:   &SpoolConfig{Dir: t.TempDir(), RetryInterval: 10 * time.Millisecond, StatsBucket: "statsd.spool"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the state of the spool is dropped while the server is down, instead of filling the spool
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, SpoolStats{}, c.SpoolStats())
+}
+
+func TestTCPReconnect(t *testing.T) {
+	server := &tcpServer{addr: "127.0.0.1:0"}
+	server.start(t)
+
+	c, err := DialConfig(Config{Addr: server.addr, Network: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// without a spool the stats are lost while the server is down, but the client is not
+	server.stop()
+	time.Sleep(10 * time.Millisecond)
+	c.Increment("lost", 1, 1)
+	assert.NotEqual(t, nil, c.Flush())
+	c.Increment("lost", 1, 1)
+	assert.NotEqual(t, nil, c.Flush())
+
+	server.start(t)
+	defer server.stop()
+	c.Increment("incr", 1, 1)
+	assert.Equal(t, nil, c.Flush())
+	for i := 0; len(server.received()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("server did not receive the stat")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"incr:1|c"}, server.received())
+}
@@ -0,0 +1,235 @@
+package sqlstats
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"time"
+)
+
+var errIsolation = errors.New("Driver does not support non-default isolation levels or read-only transactions")
+
+// wrappedConn records the metrics of a connection. It implements every optional interface of
+// driver.Conn, falling back to what database/sql would do when the wrapped connection does not.
+type wrappedConn struct {
+	conn driver.Conn
+	cfg  *config
+}
+
+func (c *wrappedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *wrappedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	start := time.Now()
+	if p, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	c.cfg.record("prepare", query, start, err)
+	if err != nil {
+		return nil, err
+	}
+	wrapped := &wrappedStmt{stmt: stmt, conn: c.conn, query: query, cfg: c.cfg}
+	if _, ok := stmt.(driver.ColumnConverter); ok {
+		return &converterStmt{wrapped}, nil
+	}
+	return wrapped, nil
+}
+
+func (c *wrappedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wrappedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *wrappedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (tx driver.Tx, err error) {
+	start := time.Now()
+	if b, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = b.BeginTx(ctx, opts)
+	} else if opts.Isolation != driver.IsolationLevel(0) || opts.ReadOnly {
+		err = errIsolation
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	c.cfg.record("begin", "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedTx{tx: tx, cfg: c.cfg}, nil
+}
+
+func (c *wrappedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (rows driver.Rows, err error) {
+	start := time.Now()
+	switch q := c.conn.(type) {
+	case driver.QueryerContext:
+		rows, err = q.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = q.Query(query, values)
+		}
+	default:
+		err = driver.ErrSkip
+	}
+	c.cfg.record("query", query, start, err)
+	return rows, err
+}
+
+func (c *wrappedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (result driver.Result, err error) {
+	start := time.Now()
+	switch e := c.conn.(type) {
+	case driver.ExecerContext:
+		result, err = e.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			result, err = e.Exec(query, values)
+		}
+	default:
+		err = driver.ErrSkip
+	}
+	c.cfg.record("exec", query, start, err)
+	return result, err
+}
+
+func (c *wrappedConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *wrappedConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *wrappedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// namedValues converts arguments for drivers without the context methods, which do not support names.
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("Driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+type wrappedStmt struct {
+	stmt driver.Stmt
+	// The connection the statement was prepared on, whose argument checks apply to it too
+	conn  driver.Conn
+	query string
+	cfg   *config
+}
+
+func (s *wrappedStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *wrappedStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *wrappedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.stmt.Exec(args)
+	s.cfg.record("exec", s.query, start, err)
+	return result, err
+}
+
+func (s *wrappedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (result driver.Result, err error) {
+	start := time.Now()
+	if e, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = e.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			result, err = s.stmt.Exec(values)
+		}
+	}
+	s.cfg.record("exec", s.query, start, err)
+	return result, err
+}
+
+func (s *wrappedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.stmt.Query(args)
+	s.cfg.record("query", s.query, start, err)
+	return rows, err
+}
+
+func (s *wrappedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (rows driver.Rows, err error) {
+	start := time.Now()
+	if q, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = q.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValues(args); err == nil {
+			rows, err = s.stmt.Query(values)
+		}
+	}
+	s.cfg.record("query", s.query, start, err)
+	return rows, err
+}
+
+// CheckNamedValue checks arguments with the statement, or its connection, the way database/sql
+// would. When neither checks them, database/sql falls back to the statement's ColumnConverter.
+func (s *wrappedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// converterStmt is a wrappedStmt of a statement that converts its arguments itself.
+type converterStmt struct {
+	*wrappedStmt
+}
+
+func (s *converterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s.stmt.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+type wrappedTx struct {
+	tx  driver.Tx
+	cfg *config
+}
+
+func (t *wrappedTx) Commit() error {
+	start := time.Now()
+	err := t.tx.Commit()
+	t.cfg.record("commit", "", start, err)
+	return err
+}
+
+func (t *wrappedTx) Rollback() error {
+	start := time.Now()
+	err := t.tx.Rollback()
+	t.cfg.record("rollback", "", start, err)
+	return err
+}
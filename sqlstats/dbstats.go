@@ -0,0 +1,47 @@
+package sqlstats
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/internal/ticker"
+)
+
+// A DBStatsCollector periodically reports the sql.DBStats of a database as gauges:
+// "<prefix>.connections.open", "<prefix>.connections.in_use", "<prefix>.connections.idle",
+// "<prefix>.wait_count" and "<prefix>.wait_duration" in milliseconds.
+type DBStatsCollector struct {
+	db     *sql.DB
+	client statsdclient.StatsClient
+	prefix string
+
+	ticker *ticker.Ticker
+}
+
+// NewDBStatsCollector returns a collector that reads db.Stats every interval and reports it under prefix.
+func NewDBStatsCollector(db *sql.DB, client statsdclient.StatsClient, prefix string, interval time.Duration) *DBStatsCollector {
+	c := &DBStatsCollector{
+		db:     db,
+		client: client,
+		prefix: prefix,
+	}
+	c.ticker = ticker.Start(interval, c.Collect)
+	return c
+}
+
+// Collect reports the stats of the database now.
+func (c *DBStatsCollector) Collect() {
+	stats := c.db.Stats()
+	c.client.Gauge(c.prefix+".connections.open", stats.OpenConnections, 1)
+	c.client.Gauge(c.prefix+".connections.in_use", stats.InUse, 1)
+	c.client.Gauge(c.prefix+".connections.idle", stats.Idle, 1)
+	c.client.Gauge(c.prefix+".wait_count", int(stats.WaitCount), 1)
+	c.client.Gauge(c.prefix+".wait_duration", int(stats.WaitDuration/time.Millisecond), 1)
+}
+
+// Close stops reporting stats. It does not close the database, which can outlive the collector.
+func (c *DBStatsCollector) Close() error {
+	c.ticker.Stop()
+	return nil
+}
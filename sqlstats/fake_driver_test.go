@@ -0,0 +1,163 @@
+package sqlstats
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errFake = errors.New("fake error")
+
+// fakeDriver opens connections answering every query with a single row, and failing statements
+// starting with "fail". With ctx set they implement the context interfaces, and only the
+// mandatory methods otherwise.
+type fakeDriver struct {
+	ctx bool
+}
+
+func (d fakeDriver) Open(name string) (driver.Conn, error) {
+	if d.ctx {
+		return &fakeCtxConn{}, nil
+	}
+	return &fakeConn{}, nil
+}
+
+type fakeConnector struct {
+	fakeDriver
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.Open("")
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return c.fakeDriver
+}
+
+// closingConnector is a connector that needs to be closed.
+type closingConnector struct {
+	fakeConnector
+	closed *bool
+}
+
+func (c closingConnector) Close() error {
+	*c.closed = true
+	return nil
+}
+
+type fakeConn struct{}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.HasPrefix(query, "fail prepare") {
+		return nil, errFake
+	}
+	if strings.HasPrefix(query, "convert") {
+		return fakeConverterStmt{fakeStmt{query}}, nil
+	}
+	return fakeStmt{query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeCtxConn struct {
+	fakeConn
+}
+
+func (c *fakeCtxConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return fakeStmt{query}.Query(nil)
+}
+
+func (c *fakeCtxConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return fakeStmt{query}.Exec(nil)
+}
+
+func (c *fakeCtxConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeStmt struct {
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(s.query, "fail") {
+		return nil, errFake
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.HasPrefix(s.query, "fail") {
+		return nil, errFake
+	}
+	return &fakeRows{}, nil
+}
+
+// fakeConverterStmt converts its arguments to "converted", and fails to run with any other.
+type fakeConverterStmt struct {
+	fakeStmt
+}
+
+func (s fakeConverterStmt) ColumnConverter(idx int) driver.ValueConverter {
+	return s
+}
+
+func (s fakeConverterStmt) ConvertValue(v any) (driver.Value, error) {
+	return "converted", nil
+}
+
+func (s fakeConverterStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, arg := range args {
+		if arg != "converted" {
+			return nil, errFake
+		}
+	}
+	return s.fakeStmt.Exec(args)
+}
+
+type fakeRows struct {
+	done bool
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"n"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = int64(1)
+	return nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return errFake
+}
@@ -0,0 +1,70 @@
+package sqlstats
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint names a statement after its first keyword and a hash of its text with literals
+// and extra whitespace removed, so that "SELECT * FROM users WHERE id = 42" and
+// "select *  from users where id = 7" both become "select_" followed by the same 8 hex digits.
+func Fingerprint(query string) string {
+	normalized := normalize(query)
+	verb := normalized
+	if i := strings.IndexAny(verb, " (;"); i >= 0 {
+		verb = verb[:i]
+	}
+	if verb == "" {
+		verb = "unknown"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(normalized))
+	return verb + "_" + strconv.FormatUint(uint64(h.Sum32())|1<<32, 16)[1:]
+}
+
+// normalize lowercases query, replaces string and number literals with "?" and collapses whitespace.
+func normalize(query string) string {
+	var b strings.Builder
+	var prev byte
+	space := false
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case ch == '\'':
+			// skip to the closing quote, '' being an escaped quote
+			for i++; i < len(query); i++ {
+				if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+					break
+				}
+			}
+			ch = '?'
+		case ch >= '0' && ch <= '9' && (space || !isIdentByte(prev)):
+			for i+1 < len(query) && (query[i+1] >= '0' && query[i+1] <= '9' || query[i+1] == '.') {
+				i++
+			}
+			ch = '?'
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			space = true
+			continue
+		case ch >= 'A' && ch <= 'Z':
+			ch += 'a' - 'A'
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(ch)
+		prev = ch
+	}
+	return b.String()
+}
+
+// isIdentByte reports whether ch can be part of a normalized identifier like "t1".
+func isIdentByte(ch byte) bool {
+	return ch == '_' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9'
+}
@@ -0,0 +1,151 @@
+// Package sqlstats records statsd metrics for database/sql drivers.
+//
+// Wrap a driver.Driver or a driver.Connector to count and time the queries, execs, prepares and
+// transactions going through it:
+//
+//	db := sql.OpenDB(sqlstats.WrapConnector(connector, client))
+//
+// Metrics are sent to "<prefix>.<op>.count", "<prefix>.<op>.duration" and "<prefix>.<op>.errors",
+// where op is one of query, exec, prepare, begin, commit and rollback.
+// With a fingerprinter, queries, execs and prepares go to "<prefix>.<op>.<fingerprint>" instead.
+package sqlstats
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+)
+
+// Default bucket prefix
+const DefaultPrefix = "sql"
+
+type config struct {
+	client      statsdclient.StatsClient
+	prefix      string
+	rate        float64
+	fingerprint func(query string) string
+}
+
+// An Option configures a wrapped driver or connector.
+type Option func(*config)
+
+// WithPrefix sets the prefix of the buckets.
+func WithPrefix(prefix string) Option {
+	return func(c *config) { c.prefix = prefix }
+}
+
+// WithSampleRate sets the sample rate of every metric.
+func WithSampleRate(rate float64) Option {
+	return func(c *config) { c.rate = rate }
+}
+
+// WithFingerprint adds a segment naming the statement to the buckets of queries, execs and prepares,
+// for example Fingerprint. It should return few distinct values, each a valid bucket segment.
+func WithFingerprint(fingerprint func(query string) string) Option {
+	return func(c *config) { c.fingerprint = fingerprint }
+}
+
+func newConfig(client statsdclient.StatsClient, opts []Option) *config {
+	c := &config{client: client, prefix: DefaultPrefix, rate: 1}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// record sends the metrics of an operation that started at start.
+// driver.ErrSkip is not an error, it only makes database/sql take another path.
+func (c *config) record(op, query string, start time.Time, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	bucket := c.prefix + "." + op
+	if query != "" && c.fingerprint != nil {
+		bucket += "." + c.fingerprint(query)
+	}
+	c.client.Increment(bucket+".count", 1, c.rate)
+	c.client.Duration(bucket+".duration", time.Since(start), c.rate)
+	if err != nil {
+		c.client.Increment(bucket+".errors", 1, c.rate)
+	}
+}
+
+// Wrap returns a driver recording the metrics of d, to register with sql.Register.
+func Wrap(d driver.Driver, client statsdclient.StatsClient, opts ...Option) driver.Driver {
+	return &wrappedDriver{d: d, cfg: newConfig(client, opts)}
+}
+
+// WrapConnector returns a connector recording the metrics of c, to open with sql.OpenDB.
+func WrapConnector(c driver.Connector, client statsdclient.StatsClient, opts ...Option) driver.Connector {
+	cfg := newConfig(client, opts)
+	return &wrappedConnector{c: c, d: &wrappedDriver{d: c.Driver(), cfg: cfg}, cfg: cfg}
+}
+
+type wrappedDriver struct {
+	d   driver.Driver
+	cfg *config
+}
+
+func (d *wrappedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.d.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedConn{conn: conn, cfg: d.cfg}, nil
+}
+
+// OpenConnector lets database/sql open connections with the context of the caller.
+func (d *wrappedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.d.(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &wrappedConnector{c: c, d: d, cfg: d.cfg}, nil
+	}
+	return &dsnConnector{name: name, d: d}, nil
+}
+
+type wrappedConnector struct {
+	c   driver.Connector
+	d   *wrappedDriver
+	cfg *config
+}
+
+func (c *wrappedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.c.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedConn{conn: conn, cfg: c.cfg}, nil
+}
+
+func (c *wrappedConnector) Driver() driver.Driver {
+	return c.d
+}
+
+// Close closes the wrapped connector when it needs to be, see sql.DB.Close.
+func (c *wrappedConnector) Close() error {
+	if closer, ok := c.c.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// dsnConnector opens connections of drivers that have no connectors of their own.
+type dsnConnector struct {
+	name string
+	d    *wrappedDriver
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.d.Open(c.name)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.d
+}
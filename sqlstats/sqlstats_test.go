@@ -0,0 +1,188 @@
+package sqlstats
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdclienttest"
+)
+
+func exercise(t *testing.T, db *sql.DB) {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT n FROM t WHERE id = 1").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if _, err := db.Exec("UPDATE t SET n = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("fail exec"); err != errFake {
+		t.Fatalf("expected the fake error, got %v", err)
+	}
+	if _, err := db.Prepare("fail prepare"); err != errFake {
+		t.Fatalf("expected the fake error, got %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+}
+
+func assertCounts(t *testing.T, client *statsdclienttest.StatsClient, counts map[string]float64) {
+	t.Helper()
+	for bucket, count := range counts {
+		var total float64
+		for _, m := range client.Metrics() {
+			if m.Bucket == bucket {
+				total += m.Float()
+			}
+		}
+		if total != count {
+			t.Errorf("%s: got %g, expected %g", bucket, total, count)
+		}
+	}
+}
+
+func TestConnector(t *testing.T) {
+	for _, ctx := range []bool{false, true} {
+		client := statsdclienttest.NewStatsClient()
+		db := sql.OpenDB(WrapConnector(fakeConnector{fakeDriver{ctx: ctx}}, client))
+		exercise(t, db)
+		db.Close()
+
+		counts := map[string]float64{
+			"sql.query.count":     1,
+			"sql.query.errors":    0,
+			"sql.exec.count":      2,
+			"sql.exec.errors":     1,
+			"sql.begin.count":     2,
+			"sql.commit.count":    1,
+			"sql.rollback.count":  1,
+			"sql.rollback.errors": 1,
+		}
+		if ctx {
+			// only the explicit Prepare
+			counts["sql.prepare.count"] = 1
+		} else {
+			// every statement is prepared when the driver cannot run it directly
+			counts["sql.prepare.count"] = 4
+		}
+		counts["sql.prepare.errors"] = 1
+		assertCounts(t, client, counts)
+		statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("sql.query.duration").Type(statsdclienttest.Timer))
+	}
+}
+
+func TestDriver(t *testing.T) {
+	client := statsdclienttest.NewStatsClient()
+	// drivers cannot be unregistered, every run needs a name of its own
+	name := "sqlstats-fake-" + strconv.Itoa(len(sql.Drivers()))
+	sql.Register(name, Wrap(fakeDriver{ctx: true}, client, WithPrefix("db"), WithFingerprint(Fingerprint)))
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.Exec("UPDATE t SET n = 2 WHERE id = 1")
+	db.Exec("update t  set n = 3 where id = 2")
+	db.Query("SELECT 1")
+
+	update := Fingerprint("UPDATE t SET n = 2 WHERE id = 1")
+	assertCounts(t, client, map[string]float64{"db.exec." + update + ".count": 2})
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.query.select_*.count"))
+}
+
+func TestFingerprint(t *testing.T) {
+	same := []string{
+		"SELECT * FROM users WHERE id = 42",
+		"select *  from users\n where id = 7",
+		"SELECT * FROM users WHERE id = 3.5",
+	}
+	for _, query := range same[1:] {
+		if Fingerprint(query) != Fingerprint(same[0]) {
+			t.Errorf("expected %q and %q to have the same fingerprint", query, same[0])
+		}
+	}
+	if fp := Fingerprint(same[0]); len(fp) != len("select_")+8 || fp[:7] != "select_" {
+		t.Errorf("unexpected fingerprint %q", fp)
+	}
+
+	different := []string{
+		"SELECT * FROM t1 WHERE name = 'it''s'",
+		"SELECT * FROM t2 WHERE name = 'x'",
+	}
+	if Fingerprint(different[0]) == Fingerprint(different[1]) {
+		t.Errorf("expected %q and %q to have different fingerprints", different[0], different[1])
+	}
+	if fp := Fingerprint("  "); fp[:8] != "unknown_" {
+		t.Errorf("unexpected fingerprint %q", fp)
+	}
+}
+
+func TestDBStatsCollector(t *testing.T) {
+	db := sql.OpenDB(fakeConnector{})
+	defer db.Close()
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := statsdclienttest.NewStatsClient()
+	collector := NewDBStatsCollector(db, client, "db", time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for len(client.Metrics()) < 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	collector.Close()
+	collector.Close()
+
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.connections.open").Type(statsdclienttest.Gauge).Value(statsdclienttest.Equal(1)))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.connections.in_use").Value(statsdclienttest.Equal(1)))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.connections.idle").Value(statsdclienttest.Equal(0)))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.wait_count"))
+	statsdclienttest.AssertMatch(t, client, statsdclienttest.Bucket("db.wait_duration"))
+
+	// no more stats once closed
+	n := len(client.Metrics())
+	time.Sleep(5 * time.Millisecond)
+	if len(client.Metrics()) != n {
+		t.Error("expected no stats after Close")
+	}
+}
+
+func TestConnectorClose(t *testing.T) {
+	closed := false
+	db := sql.OpenDB(WrapConnector(closingConnector{closed: &closed}, statsdclienttest.NewStatsClient()))
+	db.Close()
+	if !closed {
+		t.Error("the wrapped connector was not closed")
+	}
+}
+
+func TestColumnConverter(t *testing.T) {
+	db := sql.OpenDB(WrapConnector(fakeConnector{}, statsdclienttest.NewStatsClient()))
+	defer db.Close()
+	stmt, err := db.Prepare("convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	// arguments go through the converter of the statement
+	if _, err := stmt.Exec(struct{}{}); err != nil {
+		t.Errorf("arguments were not converted: %s", err)
+	}
+}
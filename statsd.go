@@ -17,10 +17,12 @@ package statsdclient
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -28,10 +30,33 @@ import (
 	"time"
 )
 
+// Packet size profiles for DialSize, see
+// https://github.com/etsy/statsd/blob/master/docs/metric_types.md#multi-metric-packets
 const (
-	defaultBufSize = 512
+	// Safe for any path across the internet.
+	PacketSizeInternet = 512
+	// Fits a 1500 byte MTU, as found on most LANs.
+	PacketSizeLAN = 1432
+	// Fits a 9000 byte MTU when jumbo frames are enabled end to end.
+	PacketSizeJumbo = 8932
+	// The largest payload a single UDP datagram can carry, for loopback and Unix sockets:
+	// 65535 bytes less the 20 byte IPv4 and 8 byte UDP headers, rather than a full 64KiB.
+	PacketSizeLoopback = 65507
+
+	// Pick one of the profiles above based on the address being dialed.
+	PacketSizeAuto = -1
 )
 
+const (
+	defaultBufSize = PacketSizeInternet
+)
+
+// ErrClosed is returned when using a client that has been closed or shut down.
+var ErrClosed = errors.New("Already closed")
+
+// ErrLineTooLong is returned when a single metric line does not fit in a packet.
+var ErrLineTooLong = errors.New("Metric line is larger than the packet size")
+
 type StatsClient interface {
 	SetPrefix(prefix string)
 	Unique(stat string, count int, rate float64) error
@@ -50,38 +75,202 @@ type Client struct {
 
 	// The prefix to be added to every key. Should include the "." at the end if desired
 	prefix string
+
+	// The DogStatsD tags added to every line, and the resulting tag section including the leading "|#"
+	rawTags []string
+	tags    string
+	tagsErr error
+
+	// How invalid characters in prefixes, buckets and tags are handled
+	sanitizer SanitizeMode
+
+	// What to do with lines that do not fit in a packet
+	oversize OversizePolicy
+
+	// The number of lines waiting in buf
+	pending int
+
+	// Called with every line as it is sent, used by MockClient
+	record func(line string)
 }
 
+// OversizePolicy decides what happens to a metric line that is larger than the packet size.
+type OversizePolicy int
+
+const (
+	// Drop the line and return ErrLineTooLong. This is the default.
+	OversizeDrop OversizePolicy = iota
+	// Send the line on its own in a single datagram, even though it is larger than the packet size.
+	OversizeDedicated
+	// Remove tags from the end of the line until it fits, dropping it with ErrLineTooLong if it still does not.
+	OversizeTruncateTags
+)
+
 func millisecond(d time.Duration) int {
 	return int(d.Seconds() * 1000)
 }
 
+// Config holds the settings used by DialConfig.
+type Config struct {
+	// The address of the statsd server, as host:port.
+	Addr string
+
+	// The network Addr is reached over, "udp" or "tcp". Defaults to "udp".
+	// Over TCP every packet ends with a newline, and the connection is dialed again after an error
+	// or once the server closed it.
+	// The resolve and failover settings below only apply to UDP, setting them with TCP is an error.
+	Network string
+
+	// The packet size, see DialSize.
+	PacketSize int
+
+	// How often Addr is resolved again, so that a server moving to a new IP address is followed.
+	// Zero resolves it only once, when dialing.
+	ResolveInterval time.Duration
+
+	// Resolver looks up Addr. Defaults to net.ResolveUDPAddr.
+	// When it fails, or returns no address, the client keeps sending to the previous one.
+	Resolver func(network, addr string) (*net.UDPAddr, error)
+
+	// A server to switch to while Addr is unreachable, or cannot be dialed. Setting it makes the
+	// client use connected UDP sockets, which notice the ICMP port unreachable replies of a server
+	// that is down. The resolve settings above cannot be combined with a secondary address.
+	SecondaryAddr string
+
+	// How often an unreachable Addr is checked, to switch back to it. Defaults to 10 seconds.
+	RecoveryInterval time.Duration
+
+	// HealthCheck reports whether Addr can be switched back to. Defaults to sending it an empty
+	// UDP datagram and watching for a port unreachable reply, see also TCPHealthCheck.
+	HealthCheck func(addr string) error
+
+	// Spool, when set, keeps packets that could not be sent on disk and sends them once
+	// the server can be reached again. Only failed writes are spooled: over UDP a server that is down
+	// rarely makes writes fail, and over TCP the packets written between a server crashing without
+	// closing the connection and the first failed write are lost.
+	Spool *SpoolConfig
+}
+
 // Dial connects to the given address on the given network using net.Dial and then returns a new client for the connection.
 func Dial(addr string) (*Client, error) {
-	conn, err := newWriteToConn(addr)
-	if err != nil {
-		return nil, err
-	}
-	return newClient(conn, 0), nil
+	return DialConfig(Config{Addr: addr})
 }
 
 // DialTimeout acts like Dial but takes a timeout. The timeout includes name resolution, if required.
 func DialTimeout(addr string, timeout time.Duration) (*Client, error) {
-	conn, err := newWriteToConn(addr)
-	if err != nil {
-		return nil, err
-	}
-	return newClient(conn, 0), nil
+	return DialConfig(Config{Addr: addr})
 }
 
 // DialSize acts like Dial but takes a packet size.
 // By default, the packet size is 512, see https://github.com/etsy/statsd/blob/master/docs/metric_types.md#multi-metric-packets for guidelines.
+// Use one of the PacketSize constants, or PacketSizeAuto to pick one from the remote address.
 func DialSize(addr string, size int) (*Client, error) {
-	conn, err := newWriteToConn(addr)
+	return DialConfig(Config{Addr: addr, PacketSize: size})
+}
+
+// DialConfig acts like Dial but takes all of its settings from cfg.
+func DialConfig(cfg Config) (*Client, error) {
+	conn, err := dialConn(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	size := cfg.PacketSize
+	if size == PacketSizeAuto {
+		size = PacketSizeFor(conn.remoteIP())
+	}
+	c := newClient(conn, size)
+	if spool, ok := conn.(*spoolConn); ok && cfg.Spool.StatsBucket != "" {
+		// the state of the spool is not spooled, so that it does not fill the spool during an outage
+		reporter := newClient(spool.direct(), size)
+		spool.setReport(func(stats SpoolStats) { c.reportSpool(reporter, cfg.Spool.StatsBucket, stats) })
+	}
+	return c, nil
+}
+
+// reportSpool sends the state of the spool as gauges under bucket through reporter, with the
+// prefix and tags of c.
+func (c *Client) reportSpool(reporter *Client, bucket string, stats SpoolStats) {
+	c.m.Lock()
+	prefix, rawTags, tags, tagsErr, sanitizer := c.prefix, c.rawTags, c.tags, c.tagsErr, c.sanitizer
+	c.m.Unlock()
+	reporter.m.Lock()
+	reporter.prefix, reporter.rawTags, reporter.tags, reporter.tagsErr, reporter.sanitizer = prefix, rawTags, tags, tagsErr, sanitizer
+	reporter.m.Unlock()
+
+	bucket = strings.TrimRight(bucket, ".")
+	reporter.Gauge(bucket+".packets", stats.Packets, 1)
+	reporter.Gauge(bucket+".bytes", int(stats.Bytes), 1)
+	reporter.Gauge(bucket+".dropped", stats.Dropped, 1)
+	reporter.Flush()
+}
+
+// A connection to a statsd server.
+type statsdConn interface {
+	io.WriteCloser
+
+	// The IP address currently being sent to
+	remoteIP() net.IP
+}
+
+// A connection whose writes can be given a deadline, like net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+func dialConn(cfg Config) (statsdConn, error) {
+	if cfg.Spool != nil {
+		spool := *cfg.Spool
+		cfg.Spool = nil
+		conn, err := dialConn(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newSpoolConn(conn, spool)
+	}
+
+	switch cfg.Network {
+	case "", "udp":
+	case "tcp":
+		if cfg.SecondaryAddr != "" || cfg.Resolver != nil || cfg.ResolveInterval > 0 {
+			return nil, errUDPOnly
+		}
+		return newTCPConn(cfg.Addr)
+	default:
+		return nil, net.UnknownNetworkError(cfg.Network)
+	}
+
+	if cfg.SecondaryAddr != "" {
+		if cfg.Resolver != nil || cfg.ResolveInterval > 0 {
+			return nil, errFailoverResolve
+		}
+		return newFailoverConn(cfg.Addr, cfg.SecondaryAddr, cfg.RecoveryInterval, cfg.HealthCheck)
+	}
+
+	if cfg.Resolver == nil {
+		cfg.Resolver = net.ResolveUDPAddr
+	}
+	conn, err := newWriteToConn(cfg.Addr, cfg.Resolver)
 	if err != nil {
 		return nil, err
 	}
-	return newClient(conn, size), nil
+	if cfg.ResolveInterval > 0 {
+		conn.startResolving(cfg.ResolveInterval)
+	}
+	return conn, nil
+}
+
+// PacketSizeFor returns the packet size profile suited to sending to ip.
+// Loopback addresses get PacketSizeLoopback, private and link-local addresses get PacketSizeLAN
+// and everything else gets PacketSizeInternet. Jumbo frames are never assumed.
+func PacketSizeFor(ip net.IP) int {
+	switch {
+	case ip.IsLoopback():
+		return PacketSizeLoopback
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		return PacketSizeLAN
+	}
+	return PacketSizeInternet
 }
 
 func newClient(conn io.WriteCloser, size int) *Client {
@@ -103,9 +292,34 @@ func (c *Client) SetPrefix(prefix string) {
 	c.prefix = strings.TrimRight(prefix, ".") + "."
 }
 
+// Set the DogStatsD tags sent with every stat, in "key:value" or "value" form.
+// Calling it without tags removes them.
+func (c *Client) SetTags(tags ...string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.rawTags = tags
+	c.tags, c.tagsErr = formatTags(tags, c.sanitizer)
+}
+
+// Set how prefixes, buckets and tags containing characters that are not allowed
+// in the statsd protocol are handled, see SanitizeMode.
+func (c *Client) SetSanitizer(mode SanitizeMode) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.sanitizer = mode
+	c.tags, c.tagsErr = formatTags(c.rawTags, mode)
+}
+
+// Set what happens to stats that are too large to fit in a packet, see OversizePolicy.
+func (c *Client) SetOversizePolicy(policy OversizePolicy) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.oversize = policy
+}
+
 // makeStatsPrefix will create a stats key prefix based on the given environment, application name, and hostname.
 func MakeStatsdPrefix(namespace, app, hostname string) string {
-	underscoreHostname := strings.Replace(hostname, ".", "_", -1)
+	underscoreHostname := dotsToUnderscores(hostname)
 	return fmt.Sprintf("%s.%s.%s.", namespace, app, underscoreHostname)
 }
 
@@ -152,7 +366,6 @@ func (c *Client) Gauge(stat string, value int, rate float64) error {
 // Increment the value of the gauge.
 func (c *Client) IncrementGauge(stat string, value int, rate float64) error {
 	return c.send(stat, rate, "+"+strconv.Itoa(value)+"|g")
-	// return c.send(stat, rate, "+%d|g", value)
 }
 
 // Decrement the value of the gauge.
@@ -169,49 +382,181 @@ func (c *Client) Unique(stat string, value int, rate float64) error {
 func (c *Client) Flush() error {
 	c.m.Lock()
 	defer c.m.Unlock()
-	return c.buf.Flush()
+	if c.buf == nil {
+		return ErrClosed
+	}
+	return c.flush()
+}
+
+// flush sends the buffered lines. When that fails they are dropped, so that the buffer can be used again.
+// Must be called with c.m held.
+func (c *Client) flush() error {
+	err := c.buf.Flush()
+	if err != nil {
+		c.buf.Reset(c.conn)
+	}
+	c.pending = 0
+	return err
+}
+
+// SpoolStats returns the state of the spool, see Config.Spool. It is empty when the client has no spool.
+func (c *Client) SpoolStats() SpoolStats {
+	if conn, ok := c.conn.(*spoolConn); ok {
+		return conn.stats()
+	}
+	return SpoolStats{}
 }
 
 // Closes the connection.
 func (c *Client) Close() error {
 	c.m.Lock()
-	defer c.m.Unlock()
 	if c.buf == nil {
-		return errors.New("Already closed")
+		c.m.Unlock()
+		return ErrClosed
 	}
-	if err := c.buf.Flush(); err != nil {
+	if err := c.flush(); err != nil {
+		c.m.Unlock()
 		return err
 	}
 	c.buf = nil
+	// not held while closing, the spool may be reporting through c while it stops
+	c.m.Unlock()
 	return c.conn.Close()
 }
 
-func (c *Client) send(stat string, rate float64, format string, args ...interface{}) error {
+// Shutdown stops accepting stats, sends what is buffered, waits for the spool to empty and closes
+// the connection, giving up on the spool once ctx is done.
+// When stats could not be sent it returns a *ShutdownError saying how many.
+func (c *Client) Shutdown(ctx context.Context) error {
+	// a server that stopped reading must not hold Shutdown up past ctx, even while a write holds c.m
+	if deadline, ok := ctx.Deadline(); ok {
+		if d, ok := c.conn.(writeDeadliner); ok {
+			d.SetWriteDeadline(deadline)
+		}
+	}
+
+	c.m.Lock()
+	if c.buf == nil {
+		c.m.Unlock()
+		return ErrClosed
+	}
+	pending := c.pending
+	err := c.flush()
+	c.buf = nil
+	c.m.Unlock()
+
+	shutdownErr := &ShutdownError{}
+	if err != nil {
+		shutdownErr.Abandoned = pending
+		shutdownErr.Err = err
+	}
+	if spool, ok := c.conn.(*spoolConn); ok {
+		spooled, err := spool.drain(ctx)
+		shutdownErr.Spooled = spooled
+		shutdownErr.add(err)
+	}
+	shutdownErr.add(c.conn.Close())
+	return shutdownErr.orNil()
+}
+
+func (c *Client) send(stat string, rate float64, value string) error {
+	return c.sendTagged(stat, rate, value, nil)
+}
+
+// sendTagged sends a stat with extra tags on top of the client's own.
+func (c *Client) sendTagged(stat string, rate float64, value string, extra []string) error {
 	if rate < 1 {
 		if rand.Float64() < rate {
-			format = format + "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+			value = value + "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
 		} else {
 			return nil
 		}
 	}
 
-	format = c.prefix + stat + ":" + format
-
 	c.m.Lock()
 	defer c.m.Unlock()
+	if c.buf == nil {
+		return ErrClosed
+	}
 
-	// Flush data if we have reach the buffer limit
-	if c.buf.Available() < len(format) {
-		if err := c.buf.Flush(); err != nil {
-			return nil
+	bucket, err := sanitize(c.prefix+stat, c.sanitizer, invalidBucketByte)
+	if err != nil {
+		return err
+	}
+	if c.tagsErr != nil {
+		return c.tagsErr
+	}
+
+	tags := c.tags
+	if len(extra) > 0 {
+		tags, err = formatTags(append(append([]string(nil), c.rawTags...), extra...), c.sanitizer)
+		if err != nil {
+			return err
 		}
 	}
+	line := bucket + ":" + value
+
+	// A line that can never fit would go out as an oversized datagram
+	if len(line)+len(tags) > c.buf.Size() {
+		switch c.oversize {
+		case OversizeDedicated:
+			return c.sendDedicated(line + tags)
+		case OversizeTruncateTags:
+			tags = truncateTags(tags, c.buf.Size()-len(line))
+			if len(line)+len(tags) > c.buf.Size() {
+				return ErrLineTooLong
+			}
+		default:
+			return ErrLineTooLong
+		}
+	}
+	line += tags
 
-	// Buffer is not empty, start filling it
+	// Buffer is not empty, the line needs a delimiter
 	if c.buf.Buffered() > 0 {
-		format = "\n" + format
+		line = "\n" + line
 	}
 
-	_, err := fmt.Fprintf(c.buf, format, args...)
+	// Flush data if we have reach the buffer limit, so the line is never split across packets
+	if c.buf.Available() < len(line) {
+		if err := c.flush(); err != nil {
+			return nil
+		}
+		line = strings.TrimPrefix(line, "\n")
+	}
+
+	_, err = c.buf.WriteString(line)
+	if err == nil {
+		c.pending++
+		if c.record != nil {
+			c.record(strings.TrimPrefix(line, "\n"))
+		}
+	}
+	return err
+}
+
+// sendDedicated flushes what is buffered and sends line on its own, in a single write.
+func (c *Client) sendDedicated(line string) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	// bufio.Writer passes large writes straight through when it is empty
+	_, err := c.buf.Write([]byte(line))
+	if err == nil && c.record != nil {
+		c.record(line)
+	}
 	return err
 }
+
+// truncateTags drops tags from the end of a "|#a,b,c" tag section until it is no longer than max.
+// The whole section is dropped when not even one tag fits.
+func truncateTags(tags string, max int) string {
+	for len(tags) > max {
+		i := strings.LastIndex(tags, ",")
+		if i < 0 {
+			return ""
+		}
+		tags = tags[:i]
+	}
+	return tags
+}
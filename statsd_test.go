@@ -153,21 +153,142 @@ func TestMultiPacket(t *testing.T) {
 	assert.Equal(t, stat, "unique:765|s")
 }
 
+func TestLineTooLong(t *testing.T) {
+	c := NewMockClientSize(16)
+	err := c.Increment("short", 1, 1)
+	assert.Equal(t, err, nil)
+	err = c.Increment("much.too.long.for.a.packet", 1, 1)
+	assert.Equal(t, err, ErrLineTooLong)
+	err = c.Flush()
+	assert.Equal(t, err, nil)
+	stat, _ := c.NextStat()
+	assert.Equal(t, stat, "short:1|c")
+	stat, err = c.NextStat()
+	assert.Equal(t, stat, "")
+	assert.NotEqual(t, err, nil)
+}
+
+var packetSizeTests = []struct {
+	ip       string
+	expected int
+}{
+	{"127.0.0.1", PacketSizeLoopback},
+	{"::1", PacketSizeLoopback},
+	{"10.1.2.3", PacketSizeLAN},
+	{"192.168.0.10", PacketSizeLAN},
+	{"fe80::1", PacketSizeLAN},
+	{"8.8.8.8", PacketSizeInternet},
+}
+
+func TestPacketSizeFor(t *testing.T) {
+	for _, test := range packetSizeTests {
+		assert.Equal(t, test.expected, PacketSizeFor(net.ParseIP(test.ip)))
+	}
+}
+
+func TestDialSizeAuto(t *testing.T) {
+	c, err := DialSize("127.0.0.1:8125", PacketSizeAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	assert.Equal(t, PacketSizeLoopback, c.buf.Size())
+}
+
+// packetRecorder keeps every write as a separate packet, the way a UDP connection would send them.
+type packetRecorder struct {
+	packets []string
+}
+
+func (r *packetRecorder) Write(p []byte) (int, error) {
+	r.packets = append(r.packets, string(p))
+	return len(p), nil
+}
+
+func (r *packetRecorder) Close() error {
+	return nil
+}
+
+var multiPacketOverflowTests = []struct {
+	name     string
+	size     int
+	policy   OversizePolicy
+	tags     []string
+	stats    []string
+	err      error
+	expected []string
+}{
+	// 34 lines of 14 bytes and their newlines fill a 512 byte packet, the rest go in the next one
+	{"lines overflow", defaultBufSize, OversizeDrop, nil,
+		strings.Fields(strings.Repeat("overflow.a ", 40)),
+		nil, []string{
+			strings.Repeat("overflow.a:1|c\n", 33) + "overflow.a:1|c",
+			strings.Repeat("overflow.a:1|c\n", 5) + "overflow.a:1|c",
+		}},
+	// a 32 byte line fills a 32 byte packet exactly
+	{"line at boundary", 32, OversizeDrop, nil,
+		[]string{"abcdefghijklmnopqrstuvwxyz01"},
+		nil, []string{"abcdefghijklmnopqrstuvwxyz01:1|c"}},
+	{"line past boundary", 32, OversizeDrop, nil,
+		[]string{"abcdefghijklmnopqrstuvwxyz012"},
+		ErrLineTooLong, nil},
+	{"line past boundary dedicated", 32, OversizeDedicated, nil,
+		[]string{"a", "abcdefghijklmnopqrstuvwxyz012", "b"},
+		nil, []string{"a:1|c", "abcdefghijklmnopqrstuvwxyz012:1|c", "b:1|c"}},
+	{"tags past boundary truncated", 32, OversizeTruncateTags, []string{"env:prod", "zone:a"},
+		[]string{"abcdefghijklm"},
+		nil, []string{"abcdefghijklm:1|c|#env:prod"}},
+	{"tags past boundary all truncated", 32, OversizeTruncateTags, []string{"env:prod"},
+		[]string{"abcdefghijklmnopqrstuvwxyz01"},
+		nil, []string{"abcdefghijklmnopqrstuvwxyz01:1|c"}},
+	{"line past boundary without tags", 32, OversizeTruncateTags, []string{"env:prod"},
+		[]string{"abcdefghijklmnopqrstuvwxyz012"},
+		ErrLineTooLong, nil},
+	// 15 bytes, a newline and 16 bytes fill a 32 byte packet exactly
+	{"lines at boundary", 32, OversizeDrop, nil,
+		[]string{"abcdefghijk", "abcdefghijkl"},
+		nil, []string{"abcdefghijk:1|c\nabcdefghijkl:1|c"}},
+	// the newline pushes the second line one byte past the packet size
+	{"lines past boundary", 32, OversizeDrop, nil,
+		[]string{"abcdefghijkl", "abcdefghijkl"},
+		nil, []string{"abcdefghijkl:1|c", "abcdefghijkl:1|c"}},
+}
+
 func TestMultiPacketOverflow(t *testing.T) {
-	c := NewMockClient()
-	for i := 0; i < 40; i++ {
-		err := c.Unique("unique", 765, 1)
+	for _, test := range multiPacketOverflowTests {
+		rec := &packetRecorder{}
+		c := newClient(rec, test.size)
+		c.SetOversizePolicy(test.policy)
+		c.SetTags(test.tags...)
+
+		var err error
+		for _, stat := range test.stats {
+			if e := c.Increment(stat, 1, 1); e != nil {
+				err = e
+			}
+		}
+		assert.Equal(t, err, test.err, test.name)
+
+		err = c.Flush()
 		assert.Equal(t, err, nil)
+		assert.Equal(t, rec.packets, test.expected, test.name)
 	}
-	for i := 0; i < 39; i++ {
-		stat, _ := c.NextStat()
-		assert.Equal(t, stat, "unique:765|s")
-	}
+}
 
-	err := c.Flush()
+func TestTags(t *testing.T) {
+	c := NewMockClient()
+	c.SetTags("env:prod", "canary")
+	err := c.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+	c.SetTags()
+	err = c.Gauge("gauge", 1, 1)
+	assert.Equal(t, err, nil)
+	err = c.Flush()
 	assert.Equal(t, err, nil)
 	stat, _ := c.NextStat()
-	assert.Equal(t, stat, "unique:765|s")
+	assert.Equal(t, stat, "incr:1|c|#env:prod,canary")
+	stat, _ = c.NextStat()
+	assert.Equal(t, stat, "gauge:1|g")
 }
 
 var prefixTests = []struct {
@@ -234,7 +355,7 @@ func TestUDPServerCloses(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = client.Gauge(strings.Repeat("k.", 256), 1, 1)
+	err = client.Gauge(strings.Repeat("k.", 200), 1, 1)
 	if err != nil {
 		t.Fatal("could not send Gauge", err)
 	}
@@ -256,7 +377,7 @@ func TestUDPServerCloses(t *testing.T) {
 	// before the change to use `exconn` as the conncection object
 	// if at first you don't, keep trying and hope you don't
 	for i := 0; i < 10; i++ {
-		err = client.Gauge(strings.Repeat("k.", 256), 1, 1.0)
+		err = client.Gauge(strings.Repeat("k.", 200), 1, 1.0)
 		if err != nil {
 			t.Fatalf("Attempt #%d: Error should not have occurred even if the UDP server is down: %s", i, err)
 		}
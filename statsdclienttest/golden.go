@@ -0,0 +1,130 @@
+package statsdclienttest
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+// UpdateGoldenEnv is the environment variable that makes AssertGolden rewrite golden files when set
+// to a true value, for example STATSD_UPDATE_GOLDEN=1 go test ./...
+const UpdateGoldenEnv = "STATSD_UPDATE_GOLDEN"
+
+// A GoldenOption changes how AssertGolden compares metrics.
+type GoldenOption func(*goldenConfig)
+
+type goldenConfig struct {
+	update bool
+}
+
+// Update makes AssertGolden rewrite the golden file instead of comparing with it when update is true,
+// for tests that have an -update flag of their own:
+//
+//	var update = flag.Bool("update", false, "rewrite golden files")
+//	...
+//	statsdclienttest.AssertGolden(t, client, "testdata/metrics.golden", statsdclienttest.Update(*update))
+func Update(update bool) GoldenOption {
+	return func(cfg *goldenConfig) {
+		cfg.update = cfg.update || update
+	}
+}
+
+// What timer values are replaced with in golden files, since they change from run to run
+const redacted = "*"
+
+// Golden returns the metrics recorded by rec in the form AssertGolden stores them: one line per
+// metric, with tags sorted and timer values redacted, sorted.
+func Golden(rec Recorder) string {
+	metrics := rec.Metrics()
+	lines := make([]string, len(metrics))
+	for i, metric := range metrics {
+		if metric.Type == statsdproto.Timer {
+			metric.Value = redacted
+		}
+		if len(metric.Tags) > 0 {
+			metric.Tags = append([]string(nil), metric.Tags...)
+			sort.Strings(metric.Tags)
+		}
+		lines[i] = metric.String()
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// AssertGolden asserts that the metrics recorded by rec, as returned by Golden, are the contents of
+// the golden file at path. The file is written instead with the Update option, or when the
+// UpdateGoldenEnv environment variable is set.
+func AssertGolden(t Testable, rec Recorder, path string, opts ...GoldenOption) {
+	cfg := goldenConfig{}
+	cfg.update, _ = strconv.ParseBool(os.Getenv(UpdateGoldenEnv))
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	got := Golden(rec)
+	if cfg.update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Errorf("could not create the directory of %s: %s", path, err)
+			return
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Errorf("could not write %s: %s", path, err)
+		}
+		return
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("could not read %s, run the tests with %s=1 to create it: %s", path, UpdateGoldenEnv, err)
+		return
+	}
+	if string(expected) != got {
+		t.Errorf("metrics differ from %s, run the tests with %s=1 to rewrite it:\n%s", path, UpdateGoldenEnv, diffLines(string(expected), got))
+	}
+}
+
+// diffLines returns a line by line diff turning expected into got.
+func diffLines(expected, got string) string {
+	a := strings.Split(strings.TrimSuffix(expected, "\n"), "\n")
+	b := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff.WriteString("  " + a[i] + "\n")
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			diff.WriteString("+ " + b[j] + "\n")
+			j++
+		default:
+			diff.WriteString("- " + a[i] + "\n")
+			i++
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,84 @@
+package statsdclienttest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+func TestGolden(t *testing.T) {
+	client := NewStatsClient()
+	client.Increment("requests", 1, 1)
+	client.Duration("latency", 23*time.Millisecond, 1)
+	client.Gauge("connections", 3, 0.5)
+
+	expected := "connections:3|g|@0.5\nlatency:*|ms\nrequests:1|c\n"
+	if got := Golden(client); got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+
+	tagged := metrics{{Bucket: "a", Value: "1", Type: statsdproto.Counter, Tags: []string{"z:1", "a:2"}}}
+	if got := Golden(tagged); got != "a:1|c|#a:2,z:1\n" {
+		t.Errorf("expected sorted tags, got %q", got)
+	}
+
+	if got := Golden(metrics{}); got != "" {
+		t.Errorf("expected no lines, got %q", got)
+	}
+}
+
+func TestAssertGolden(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdata", "metrics.golden")
+	client := NewStatsClient()
+	client.Increment("a", 1, 1)
+	client.Increment("b", 1, 1)
+
+	tester := &fakeTestable{}
+	AssertGolden(tester, client, path)
+	if len(tester.errors) != 1 || !strings.Contains(tester.errors[0], UpdateGoldenEnv+"=1") {
+		t.Fatalf("expected a missing file error, got %v", tester.errors)
+	}
+
+	tester.reset()
+	AssertGolden(tester, client, path, Update(true))
+	if len(tester.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", tester.errors)
+	}
+	written, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written) != "a:1|c\nb:1|c\n" {
+		t.Errorf("unexpected golden file %q", written)
+	}
+
+	AssertGolden(tester, client, path, Update(false))
+	if len(tester.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", tester.errors)
+	}
+
+	changed := NewStatsClient()
+	changed.Increment("a", 2, 1)
+	changed.Increment("b", 1, 1)
+	AssertGolden(tester, changed, path)
+	if len(tester.errors) != 1 {
+		t.Fatalf("got %d errors, expected 1", len(tester.errors))
+	}
+	if !strings.HasSuffix(tester.errors[0], "- a:1|c\n+ a:2|c\n  b:1|c\n") {
+		t.Errorf("unexpected diff:\n%s", tester.errors[0])
+	}
+
+	t.Setenv(UpdateGoldenEnv, "1")
+	tester.reset()
+	AssertGolden(tester, changed, path)
+	if len(tester.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", tester.errors)
+	}
+	if written, _ := os.ReadFile(path); string(written) != "a:2|c\nb:1|c\n" {
+		t.Errorf("golden file was not rewritten, got %q", written)
+	}
+}
@@ -0,0 +1,265 @@
+package statsdclienttest
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+// Metric types, for Matcher.Type
+const (
+	Counter      = statsdproto.Counter
+	Gauge        = statsdproto.Gauge
+	Timer        = statsdproto.Timer
+	Set          = statsdproto.Set
+	Histogram    = statsdproto.Histogram
+	Distribution = statsdproto.Distribution
+)
+
+// A Recorder is anything that records metrics: StatsClient, Server and statsdclient.MockClient.
+type Recorder interface {
+	Metrics() []statsdproto.Metric
+}
+
+// A ValueMatcher matches the numeric value of a metric.
+type ValueMatcher struct {
+	match func(v float64) bool
+	desc  string
+}
+
+func (v ValueMatcher) String() string {
+	return v.desc
+}
+
+// Equal matches values equal to want.
+func Equal(want float64) ValueMatcher {
+	return ValueMatcher{func(v float64) bool { return v == want }, formatFloat(want)}
+}
+
+// GreaterThan matches values greater than min.
+func GreaterThan(min float64) ValueMatcher {
+	return ValueMatcher{func(v float64) bool { return v > min }, "> " + formatFloat(min)}
+}
+
+// LessThan matches values less than max.
+func LessThan(max float64) ValueMatcher {
+	return ValueMatcher{func(v float64) bool { return v < max }, "< " + formatFloat(max)}
+}
+
+// Between matches values from min to max, inclusive.
+func Between(min, max float64) ValueMatcher {
+	return ValueMatcher{func(v float64) bool { return v >= min && v <= max },
+		"between " + formatFloat(min) + " and " + formatFloat(max)}
+}
+
+// Duration matches timer values, in milliseconds, within tolerance of d.
+func Duration(d, tolerance time.Duration) ValueMatcher {
+	ms := float64(d) / float64(time.Millisecond)
+	tol := float64(tolerance) / float64(time.Millisecond)
+	return ValueMatcher{func(v float64) bool { return math.Abs(v-ms) <= tol }, d.String() + " ± " + tolerance.String()}
+}
+
+// A TagMatcher matches the tags of a metric.
+type TagMatcher struct {
+	match func(tags []string) bool
+	desc  string
+}
+
+func (t TagMatcher) String() string {
+	return t.desc
+}
+
+// Has matches metrics with the tag key:value.
+func Has(key, value string) TagMatcher {
+	tag := key + ":" + value
+	return TagMatcher{func(tags []string) bool {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}, tag}
+}
+
+// HasKey matches metrics with a tag for key, whatever its value.
+func HasKey(key string) TagMatcher {
+	return TagMatcher{func(tags []string) bool {
+		for _, t := range tags {
+			if t == key || strings.HasPrefix(t, key+":") {
+				return true
+			}
+		}
+		return false
+	}, key + ":*"}
+}
+
+// A Matcher matches recorded metrics. Start one with Bucket and narrow it down with its methods:
+//
+//	Bucket("http.*.latency").Type(Timer).Value(Duration(50*time.Millisecond, 10*time.Millisecond))
+type Matcher struct {
+	bucket string
+	typ    statsdproto.Type
+	value  *ValueMatcher
+	rate   *float64
+	tags   []TagMatcher
+}
+
+// Bucket matches metrics whose bucket matches pattern, using the syntax of path.Match.
+func Bucket(pattern string) *Matcher {
+	return &Matcher{bucket: pattern}
+}
+
+// Type narrows m down to metrics of type t.
+func (m *Matcher) Type(t statsdproto.Type) *Matcher {
+	m.typ = t
+	return m
+}
+
+// Value narrows m down to metrics whose value matches v.
+func (m *Matcher) Value(v ValueMatcher) *Matcher {
+	m.value = &v
+	return m
+}
+
+// Rate narrows m down to metrics sent with the sample rate r.
+func (m *Matcher) Rate(r float64) *Matcher {
+	m.rate = &r
+	return m
+}
+
+// Tags narrows m down to metrics matching all of tags.
+func (m *Matcher) Tags(tags ...TagMatcher) *Matcher {
+	m.tags = append(m.tags, tags...)
+	return m
+}
+
+// Matches reports whether metric matches m.
+func (m *Matcher) Matches(metric statsdproto.Metric) bool {
+	return len(m.mismatches(metric)) == 0
+}
+
+// mismatches lists why metric does not match m.
+func (m *Matcher) mismatches(metric statsdproto.Metric) []string {
+	var reasons []string
+	if ok, _ := path.Match(m.bucket, metric.Bucket); !ok {
+		reasons = append(reasons, fmt.Sprintf("bucket is not %q", m.bucket))
+	}
+	if m.typ != "" && metric.Type != m.typ {
+		reasons = append(reasons, fmt.Sprintf("type is not %s", m.typ))
+	}
+	if m.value != nil && !m.value.match(metric.Float()) {
+		reasons = append(reasons, fmt.Sprintf("value is not %s", m.value))
+	}
+	if m.rate != nil && metric.Rate != *m.rate {
+		reasons = append(reasons, fmt.Sprintf("rate is not %s", formatFloat(*m.rate)))
+	}
+	for _, tag := range m.tags {
+		if !tag.match(metric.Tags) {
+			reasons = append(reasons, fmt.Sprintf("tags do not have %s", tag))
+		}
+	}
+	return reasons
+}
+
+func (m *Matcher) String() string {
+	parts := []string{fmt.Sprintf("Bucket(%q)", m.bucket)}
+	if m.typ != "" {
+		parts = append(parts, fmt.Sprintf("Type(%s)", m.typ))
+	}
+	if m.value != nil {
+		parts = append(parts, fmt.Sprintf("Value(%s)", m.value))
+	}
+	if m.rate != nil {
+		parts = append(parts, fmt.Sprintf("Rate(%s)", formatFloat(*m.rate)))
+	}
+	for _, tag := range m.tags {
+		parts = append(parts, fmt.Sprintf("Tags(%s)", tag))
+	}
+	return strings.Join(parts, ".")
+}
+
+// How many of the closest metrics a failed assertion lists
+const closestMetrics = 3
+
+// closest describes the metrics that came closest to matching m, for failure messages.
+func (m *Matcher) closest(metrics []statsdproto.Metric) string {
+	if len(metrics) == 0 {
+		return "no metrics were recorded"
+	}
+
+	type candidate struct {
+		metric   statsdproto.Metric
+		reasons  []string
+		distance int
+	}
+	candidates := make([]candidate, len(metrics))
+	for i, metric := range metrics {
+		candidates[i] = candidate{metric, m.mismatches(metric), editDistance(m.bucket, metric.Bucket)}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if len(candidates[i].reasons) != len(candidates[j].reasons) {
+			return len(candidates[i].reasons) < len(candidates[j].reasons)
+		}
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	lines := []string{"closest recorded metrics:"}
+	for i := 0; i < len(candidates) && i < closestMetrics; i++ {
+		lines = append(lines, fmt.Sprintf("\t%s\t(%s)", candidates[i].metric.String(), strings.Join(candidates[i].reasons, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// AssertMatch asserts that at least one metric recorded by rec matches m.
+// On failure the closest recorded metrics are listed with the reasons they did not match.
+func AssertMatch(t Testable, rec Recorder, m *Matcher) {
+	metrics := rec.Metrics()
+	for _, metric := range metrics {
+		if m.Matches(metric) {
+			return
+		}
+	}
+	t.Errorf("no metric matched %s\n%s", m, m.closest(metrics))
+}
+
+// AssertNoMatch asserts that no metric recorded by rec matches m.
+func AssertNoMatch(t Testable, rec Recorder, m *Matcher) {
+	for _, metric := range rec.Metrics() {
+		if m.Matches(metric) {
+			t.Errorf("expected no metric to match %s, got %s", m, metric.String())
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package statsdclienttest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+type metrics []statsdproto.Metric
+
+func (m metrics) Metrics() []statsdproto.Metric {
+	return m
+}
+
+func TestMatcher(t *testing.T) {
+	metric := statsdproto.Metric{Bucket: "http.get.latency", Value: "52.5", Type: Timer, Rate: 0.5, Tags: []string{"env:prod", "region:us"}}
+
+	tests := []struct {
+		matcher *Matcher
+		matches bool
+	}{
+		{Bucket("http.get.latency"), true},
+		{Bucket("http.*.latency"), true},
+		{Bucket("http.*"), true},
+		{Bucket("http.post.*"), false},
+		{Bucket("http.*.latency").Type(Timer), true},
+		{Bucket("http.*.latency").Type(Counter), false},
+		{Bucket("*").Value(GreaterThan(50)), true},
+		{Bucket("*").Value(LessThan(50)), false},
+		{Bucket("*").Value(Between(52.5, 60)), true},
+		{Bucket("*").Value(Equal(52)), false},
+		{Bucket("*").Value(Duration(50*time.Millisecond, 5*time.Millisecond)), true},
+		{Bucket("*").Value(Duration(50*time.Millisecond, time.Millisecond)), false},
+		{Bucket("*").Rate(0.5), true},
+		{Bucket("*").Rate(1), false},
+		{Bucket("*").Tags(Has("env", "prod"), HasKey("region")), true},
+		{Bucket("*").Tags(Has("env", "dev")), false},
+		{Bucket("*").Tags(HasKey("host")), false},
+	}
+	for _, test := range tests {
+		if got := test.matcher.Matches(metric); got != test.matches {
+			t.Errorf("%s.Matches(%s) = %v, expected %v", test.matcher, metric.String(), got, test.matches)
+		}
+	}
+}
+
+func TestMatcherString(t *testing.T) {
+	m := Bucket("x").Type(Counter).Value(GreaterThan(3)).Rate(1).Tags(Has("env", "prod"))
+	expected := `Bucket("x").Type(c).Value(> 3).Rate(1).Tags(env:prod)`
+	if m.String() != expected {
+		t.Errorf("got %s, expected %s", m, expected)
+	}
+}
+
+func TestAssertMatch(t *testing.T) {
+	client := NewStatsClient()
+	client.Increment("requests", 4, 1)
+	client.Duration("latency", 20*time.Millisecond, 1)
+
+	tester := &fakeTestable{}
+	AssertMatch(tester, client, Bucket("requests").Type(Counter).Value(GreaterThan(3)).Rate(1))
+	AssertMatch(tester, client, Bucket("latency").Type(Timer).Value(Duration(20*time.Millisecond, 0)))
+	AssertNoMatch(tester, client, Bucket("requests").Type(Gauge))
+	if len(tester.errors) != 0 {
+		t.Fatalf("unexpected errors: %v", tester.errors)
+	}
+
+	AssertMatch(tester, client, Bucket("requests").Type(Counter).Value(GreaterThan(10)))
+	AssertNoMatch(tester, client, Bucket("requests"))
+	if len(tester.errors) != 2 {
+		t.Fatalf("got %d errors, expected 2: %v", len(tester.errors), tester.errors)
+	}
+}
+
+func TestAssertMatchClosest(t *testing.T) {
+	rec := metrics{
+		{Bucket: "db.query", Value: "1", Type: Counter, Rate: 1},
+		{Bucket: "http.get.latncy", Value: "2", Type: Timer, Rate: 1},
+		{Bucket: "http.get.latency", Value: "2", Type: Timer, Rate: 1},
+		{Bucket: "http.requests", Value: "1", Type: Counter, Rate: 1},
+		{Bucket: "cache.hits", Value: "1", Type: Counter, Rate: 1},
+	}
+
+	tester := &fakeTestable{}
+	AssertMatch(tester, rec, Bucket("http.*.latency").Type(Timer).Value(GreaterThan(3)))
+	if len(tester.errors) != 1 {
+		t.Fatalf("got %d errors, expected 1", len(tester.errors))
+	}
+	lines := strings.Split(tester.errors[0], "\n")
+	if len(lines) != 2+closestMetrics {
+		t.Fatalf("expected %d closest metrics, got:\n%s", closestMetrics, tester.errors[0])
+	}
+	if !strings.HasPrefix(lines[2], "\thttp.get.latency:2|ms\t(value is not > 3)") {
+		t.Errorf("expected the closest metric first, got:\n%s", tester.errors[0])
+	}
+	if !strings.HasPrefix(lines[3], "\thttp.get.latncy:2|ms") {
+		t.Errorf("expected the misspelled bucket second, got:\n%s", tester.errors[0])
+	}
+
+	tester.reset()
+	AssertMatch(tester, metrics{}, Bucket("x"))
+	if len(tester.errors) != 1 || !strings.Contains(tester.errors[0], "no metrics were recorded") {
+		t.Errorf("unexpected errors: %v", tester.errors)
+	}
+}
+
+func TestStatsClientMetrics(t *testing.T) {
+	client := NewStatsClient()
+	client.SetPrefix("app")
+	client.Increment("a", 1, 1)
+	client.Decrement("b", 2, 0.5)
+	client.Gauge("c", 3, 1)
+	client.Unique("d", 4, 1)
+	client.Duration("e", 1500*time.Microsecond, 1)
+
+	expected := []string{"app.a:1|c", "app.b:-2|c|@0.5", "app.c:3|g", "app.d:4|s", "app.e:1.5|ms"}
+	got := client.Metrics()
+	if len(got) != len(expected) {
+		t.Fatalf("got %d metrics, expected %d", len(got), len(expected))
+	}
+	for i, metric := range got {
+		if metric.String() != expected[i] {
+			t.Errorf("got %s, expected %s", metric.String(), expected[i])
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package statsdclienttest
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+// How long the Server assertions wait for a metric to arrive
+var DefaultWait = time.Second
+
+// A Server is a statsd server for integration tests. It listens for UDP and TCP on ephemeral
+// ports of the loopback interface, and parses every packet it receives.
+// Malformed lines fail the test when it finishes.
+type Server struct {
+	t   testing.TB
+	udp *net.UDPConn
+	tcp net.Listener
+
+	m       sync.Mutex
+	metrics []statsdproto.Metric
+	errors  []error
+	conns   []net.Conn
+	closed  bool
+	// Closed and replaced every time metrics arrive
+	received chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a Server that is shut down when the test finishes.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("could not listen for UDP: %s", err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		udp.Close()
+		t.Fatalf("could not listen for TCP: %s", err)
+	}
+
+	s := &Server{
+		t:        t,
+		udp:      udp,
+		tcp:      tcp,
+		received: make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(s.close)
+	return s
+}
+
+// Addr returns the UDP address of the server, for Dial.
+func (s *Server) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// TCPAddr returns the TCP address of the server.
+func (s *Server) TCPAddr() string {
+	return s.tcp.Addr().String()
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.udp.Read(buf)
+		if err != nil {
+			return
+		}
+		s.parse(string(buf[:n]))
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		s.m.Lock()
+		if s.closed {
+			// accepted while closing, after the connections were closed
+			s.m.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns = append(s.conns, conn)
+		s.wg.Add(1)
+		s.m.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				s.parse(scanner.Text())
+			}
+		}()
+	}
+}
+
+func (s *Server) parse(packet string) {
+	metrics, err := statsdproto.ParsePacket(packet)
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+	if err != nil {
+		s.errors = append(s.errors, err)
+	}
+	close(s.received)
+	s.received = make(chan struct{})
+}
+
+func (s *Server) close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.m.Lock()
+	s.closed = true
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.m.Unlock()
+	s.wg.Wait()
+
+	for _, err := range s.errors {
+		s.t.Errorf("statsd server received a malformed line: %s", err)
+	}
+}
+
+// Metrics returns every metric received so far, oldest first.
+func (s *Server) Metrics() []statsdproto.Metric {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]statsdproto.Metric(nil), s.metrics...)
+}
+
+// Find returns the metrics received for bucket, oldest first.
+func (s *Server) Find(bucket string) []statsdproto.Metric {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var found []statsdproto.Metric
+	for _, m := range s.metrics {
+		if m.Bucket == bucket {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// Reset forgets every metric received so far.
+func (s *Server) Reset() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.metrics = nil
+}
+
+// waitFor waits up to timeout for a metric matching match to arrive, and returns the first one.
+func (s *Server) waitFor(timeout time.Duration, match func(statsdproto.Metric) bool) (statsdproto.Metric, bool) {
+	deadline := time.After(timeout)
+	for {
+		s.m.Lock()
+		received := s.received
+		for _, m := range s.metrics {
+			if match(m) {
+				s.m.Unlock()
+				return m, true
+			}
+		}
+		s.m.Unlock()
+
+		select {
+		case <-received:
+		case <-deadline:
+			return statsdproto.Metric{}, false
+		}
+	}
+}
+
+// WaitFor waits up to timeout for a metric to arrive for bucket, and returns the first one.
+func (s *Server) WaitFor(bucket string, timeout time.Duration) (statsdproto.Metric, bool) {
+	return s.waitFor(timeout, func(m statsdproto.Metric) bool { return m.Bucket == bucket })
+}
+
+// AssertReceived asserts that a metric arrives for bucket within DefaultWait.
+func (s *Server) AssertReceived(t Testable, bucket string) {
+	if _, ok := s.WaitFor(bucket, DefaultWait); !ok {
+		t.Errorf("expected stat %q to be received, got %s", bucket, s.summary())
+	}
+}
+
+// AssertMetric asserts that a metric equal to expected arrives within DefaultWait.
+// A zero Rate in expected stands for 1.
+func (s *Server) AssertMetric(t Testable, expected statsdproto.Metric) {
+	if expected.Rate == 0 {
+		expected.Rate = 1
+	}
+	_, ok := s.waitFor(DefaultWait, func(m statsdproto.Metric) bool { return reflect.DeepEqual(m, expected) })
+	if !ok {
+		t.Errorf("expected %q to be received, got %s", expected.String(), s.summary())
+	}
+}
+
+// AssertNotReceived asserts that no metric arrives for bucket within wait.
+func (s *Server) AssertNotReceived(t Testable, bucket string, wait time.Duration) {
+	if m, ok := s.WaitFor(bucket, wait); ok {
+		t.Errorf("expected stat %q not to be received, got %q", bucket, m.String())
+	}
+}
+
+// summary lists the metrics received so far, for failure messages.
+func (s *Server) summary() string {
+	metrics := s.Metrics()
+	if len(metrics) == 0 {
+		return "nothing"
+	}
+	return "\n\t" + strings.ReplaceAll(statsdproto.Encode(metrics), "\n", "\n\t")
+}
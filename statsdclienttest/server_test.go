@@ -0,0 +1,77 @@
+package statsdclienttest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sendgrid/go-statsdclient"
+	"github.com/sendgrid/go-statsdclient/statsdproto"
+)
+
+func TestServer(t *testing.T) {
+	server := NewServer(t)
+
+	client, err := statsdclient.Dial(server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetPrefix("app")
+	client.SetTags("env:test")
+
+	client.Increment("incr", 1, 1)
+	client.Gauge("gauge", 5, 1)
+	client.Timing("timing", 350, 1)
+	if err := client.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.AssertReceived(t, "app.incr")
+	server.AssertMetric(t, statsdproto.Metric{
+		Bucket: "app.gauge",
+		Value:  "5",
+		Type:   statsdproto.Gauge,
+		Tags:   []string{"env:test"},
+	})
+	server.AssertNotReceived(t, "app.missing", 10*time.Millisecond)
+
+	m, ok := server.WaitFor("app.timing", time.Second)
+	if !ok || m.Float() != 350 {
+		t.Fatalf("got %+v, expected a timing of 350", m)
+	}
+	if n := len(server.Find("app.incr")); n != 1 {
+		t.Fatalf("got %d increments, expected 1", n)
+	}
+
+	server.Reset()
+	if n := len(server.Metrics()); n != 0 {
+		t.Fatalf("got %d metrics after Reset, expected none", n)
+	}
+}
+
+func TestServerTCP(t *testing.T) {
+	server := NewServer(t)
+
+	client, err := statsdclient.DialConfig(statsdclient.Config{Addr: server.TCPAddr(), Network: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Increment("incr", 1, 1)
+	client.Flush()
+	server.AssertReceived(t, "incr")
+}
+
+func TestServerAssertionsFail(t *testing.T) {
+	server := NewServer(t)
+	tester := &fakeTestable{}
+	defer func(wait time.Duration) { DefaultWait = wait }(DefaultWait)
+	DefaultWait = 10 * time.Millisecond
+
+	server.AssertReceived(tester, "missing")
+	server.AssertMetric(tester, statsdproto.Metric{Bucket: "missing", Value: "1", Type: statsdproto.Counter})
+	if len(tester.errors) != 2 {
+		t.Fatalf("got %d errors, expected 2:\n%#v", len(tester.errors), tester.errors)
+	}
+}
@@ -1,8 +1,12 @@
 package statsdclienttest
 
 import (
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/sendgrid/go-statsdclient/statsdproto"
 )
 
 // Any type used for reporting errors. This will usually be your testing.T variable
@@ -24,6 +28,12 @@ type StatsClient struct {
 	// The list of stat commands that have been issued to the stat logger
 	commands map[StatsCommand]int
 
+	// Every stat command in the order it was issued
+	events []StatsCommand
+
+	// The prefix added to every stat, see SetPrefix
+	prefix string
+
 	// The accumulated values of each stat
 	Values map[string]int
 
@@ -34,15 +44,29 @@ type StatsClient struct {
 	mutex sync.RWMutex
 }
 
+// SetPrefix sets the prefix added to every stat logged from now on, the same way
+// statsdclient.Client.SetPrefix does.
 func (m *StatsClient) SetPrefix(prefix string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
+	m.prefix = strings.TrimRight(prefix, ".") + "."
+}
+
+// log records cmd with the prefix added to its stat, and returns the prefixed stat.
+// Must be called with m.mutex held.
+func (m *StatsClient) log(cmd StatsCommand) string {
+	cmd.Stat = m.prefix + cmd.Stat
+	m.commands[cmd] += 1
+	m.events = append(m.events, cmd)
+	return cmd.Stat
 }
 
 func (m *StatsClient) Unique(stat string, value int, sampleRate float64) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.commands[StatsCommand{"Unique", stat, value, sampleRate}] += 1
+	stat = m.log(StatsCommand{"Unique", stat, value, sampleRate})
 	m.Values[stat] = value
 	return nil
 }
@@ -51,7 +75,7 @@ func (m *StatsClient) Increment(stat string, delta int, sampleRate float64) erro
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.commands[StatsCommand{"Increment", stat, delta, sampleRate}] += 1
+	stat = m.log(StatsCommand{"Increment", stat, delta, sampleRate})
 	m.Values[stat] += delta
 	return nil
 }
@@ -60,7 +84,7 @@ func (m *StatsClient) Decrement(stat string, delta int, sampleRate float64) erro
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.commands[StatsCommand{"Decrement", stat, delta, sampleRate}] += 1
+	stat = m.log(StatsCommand{"Decrement", stat, delta, sampleRate})
 	m.Values[stat] -= delta
 	return nil
 }
@@ -69,7 +93,7 @@ func (m *StatsClient) Gauge(stat string, value int, sampleRate float64) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.commands[StatsCommand{"Gauge", stat, value, sampleRate}] += 1
+	stat = m.log(StatsCommand{"Gauge", stat, value, sampleRate})
 	m.Values[stat] = value
 	return nil
 }
@@ -78,7 +102,7 @@ func (m *StatsClient) Duration(stat string, duration time.Duration, sampleRate f
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	m.commands[StatsCommand{"Duration", stat, int(duration), sampleRate}] += 1
+	stat = m.log(StatsCommand{"Duration", stat, int(duration), sampleRate})
 	m.Values[stat] = int(duration / time.Millisecond)
 	return nil
 }
@@ -91,9 +115,85 @@ func (m *StatsClient) Close() error {
 // AssertStat asserts that a given stat is in the list of logged stats, then removes it
 func (m *StatsClient) AssertStat(t Testable, stat StatsCommand) {
 	m.AssertLoggedN(t, stat, 1)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	delete(m.commands, stat)
 }
 
+// Events returns every stat command in the order it was issued, including the ones removed by AssertStat.
+func (m *StatsClient) Events() []StatsCommand {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return append([]StatsCommand(nil), m.events...)
+}
+
+// Metrics returns every stat command in the order it was issued, as the metrics a
+// statsdclient.Client would have sent for them.
+func (m *StatsClient) Metrics() []statsdproto.Metric {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	metrics := make([]statsdproto.Metric, len(m.events))
+	for i, event := range m.events {
+		metric := statsdproto.Metric{Bucket: event.Stat, Value: strconv.Itoa(event.Value), Rate: event.SampleRate}
+		switch event.Operation {
+		case "Increment":
+			metric.Type = statsdproto.Counter
+		case "Decrement":
+			metric.Type = statsdproto.Counter
+			metric.Value = strconv.Itoa(-event.Value)
+		case "Gauge":
+			metric.Type = statsdproto.Gauge
+		case "Unique":
+			metric.Type = statsdproto.Set
+		case "Duration":
+			metric.Type = statsdproto.Timer
+			metric.Value = strconv.FormatFloat(float64(event.Value)/float64(time.Millisecond), 'f', -1, 64)
+		}
+		metrics[i] = metric
+	}
+	return metrics
+}
+
+// AssertSequence asserts that the given stats were logged in this order. Other stats may have
+// been logged before, after or in between them.
+func (m *StatsClient) AssertSequence(t Testable, stats ...StatsCommand) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	next := 0
+	for _, event := range m.events {
+		if next < len(stats) && event == stats[next] {
+			next++
+		}
+	}
+	if next < len(stats) {
+		t.Errorf("stat %+v not logged in sequence after %d of %d stats, logged stats were %+v",
+			stats[next], next, len(stats), m.events)
+	}
+}
+
+// AssertContains asserts that each of the given stats was logged, in any order.
+// A stat given twice must have been logged at least twice.
+func (m *StatsClient) AssertContains(t Testable, stats ...StatsCommand) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	logged := make(map[StatsCommand]int)
+	for _, event := range m.events {
+		logged[event]++
+	}
+	for _, stat := range stats {
+		if logged[stat] == 0 {
+			t.Errorf("expected stat %+v to be logged, logged stats were %+v", stat, m.events)
+			continue
+		}
+		logged[stat]--
+	}
+}
+
 // AssertValue asserts that the value of the stat with the given stat matches the given value.
 // If the stat has not been logged, the test will fail.
 func (m *StatsClient) AssertValue(t Testable, stat string, value int) {
@@ -226,3 +226,56 @@ func TestAsserts(t *testing.T) {
 		}
 	}
 }
+
+func TestStatsClientPrefix(t *testing.T) {
+	testClient := NewStatsClient()
+	testClient.Increment("before", 1, 1)
+	testClient.SetPrefix("app..")
+	testClient.Increment("after", 1, 1)
+
+	testClient.AssertStat(t, StatsCommand{"Increment", "before", 1, 1})
+	testClient.AssertStat(t, StatsCommand{"Increment", "app.after", 1, 1})
+	testClient.AssertValue(t, "app.after", 1)
+}
+
+func TestAssertSequence(t *testing.T) {
+	testClient := NewStatsClient()
+	a := StatsCommand{"Increment", "a", 1, 1}
+	b := StatsCommand{"Gauge", "b", 2, 1}
+	c := StatsCommand{"Decrement", "c", 1, 1}
+	testClient.Increment("a", 1, 1)
+	testClient.Decrement("c", 1, 1)
+	testClient.Gauge("b", 2, 1)
+	testClient.Increment("a", 1, 1)
+
+	testClient.AssertSequence(t, a, b)
+	testClient.AssertSequence(t, c, b, a)
+	testClient.AssertSequence(t, a, a)
+	if len(testClient.Events()) != 4 {
+		t.Fatalf("got %d events, expected 4", len(testClient.Events()))
+	}
+
+	tester := &fakeTestable{}
+	testClient.AssertSequence(tester, b, c)
+	testClient.AssertSequence(tester, a, a, a)
+	if len(tester.errors) != 2 {
+		t.Fatalf("AssertSequence got %d errors, expected 2:\n%#v", len(tester.errors), tester.errors)
+	}
+}
+
+func TestAssertContains(t *testing.T) {
+	testClient := NewStatsClient()
+	a := StatsCommand{"Increment", "a", 1, 1}
+	b := StatsCommand{"Gauge", "b", 2, 1}
+	testClient.Gauge("b", 2, 1)
+	testClient.Increment("a", 1, 1)
+
+	testClient.AssertContains(t, a, b)
+	testClient.AssertContains(t, b)
+
+	tester := &fakeTestable{}
+	testClient.AssertContains(tester, a, a, StatsCommand{"Increment", "c", 1, 1})
+	if len(tester.errors) != 2 {
+		t.Fatalf("AssertContains got %d errors, expected 2:\n%#v", len(tester.errors), tester.errors)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Package statsdproto parses and encodes statsd metric lines and packets, including the sample
+rates and tags of the DogStatsD extensions.
+
+A line looks like:
+
+	bucket:value|type|@rate|#tag1,key:tag2
+
+where the rate and tags are optional. A packet holds several lines separated by newlines.
+*/
+package statsdproto
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Type is the statsd metric type, as written on the wire.
+type Type string
+
+const (
+	Counter      Type = "c"
+	Gauge        Type = "g"
+	Timer        Type = "ms"
+	Set          Type = "s"
+	Histogram    Type = "h"
+	Distribution Type = "d"
+)
+
+func (t Type) valid() bool {
+	switch t {
+	case Counter, Gauge, Timer, Set, Histogram, Distribution:
+		return true
+	}
+	return false
+}
+
+// Metric is a single metric line.
+type Metric struct {
+	Bucket string
+
+	// The value as written, for example "1", "-4", "123.456789" or "+10" for a gauge delta.
+	// Sets may hold any value.
+	Value string
+
+	Type Type
+
+	// The sample rate, 1 when the line has none
+	Rate float64
+
+	Tags []string
+}
+
+// Float returns the numeric value of the metric, or 0 when it is not a number.
+func (m Metric) Float() float64 {
+	f, _ := strconv.ParseFloat(m.Value, 64)
+	return f
+}
+
+// IsDelta reports whether the metric changes a gauge by its value instead of setting it.
+func (m Metric) IsDelta() bool {
+	return m.Type == Gauge && (strings.HasPrefix(m.Value, "+") || strings.HasPrefix(m.Value, "-"))
+}
+
+// String encodes the metric as a line, without a trailing newline.
+func (m Metric) String() string {
+	return string(m.AppendLine(nil))
+}
+
+// AppendLine appends the metric, encoded as a line without a trailing newline, to dst.
+func (m Metric) AppendLine(dst []byte) []byte {
+	dst = append(dst, m.Bucket...)
+	dst = append(dst, ':')
+	dst = append(dst, m.Value...)
+	dst = append(dst, '|')
+	dst = append(dst, m.Type...)
+	if m.Rate > 0 && m.Rate < 1 {
+		dst = append(dst, "|@"...)
+		dst = strconv.AppendFloat(dst, m.Rate, 'f', -1, 64)
+	}
+	if len(m.Tags) > 0 {
+		dst = append(dst, "|#"...)
+		for i, tag := range m.Tags {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, tag...)
+		}
+	}
+	return dst
+}
+
+// Encode encodes metrics as a packet, one line per metric.
+func Encode(metrics []Metric) string {
+	var b []byte
+	for i, m := range metrics {
+		if i > 0 {
+			b = append(b, '\n')
+		}
+		b = m.AppendLine(b)
+	}
+	return string(b)
+}
+
+// SyntaxError describes a malformed line.
+type SyntaxError struct {
+	// The malformed line
+	Line string
+
+	// The byte offset in Line where the problem was found
+	Offset int
+
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("statsdproto: %s at offset %d of %q", e.Msg, e.Offset, e.Line)
+}
+
+// InvalidBucketByte reports whether b cannot appear in a bucket: it would be taken for a separator
+// or break the line. Clients replace or reject these before sending.
+func InvalidBucketByte(b byte) bool {
+	switch b {
+	case ':', '|', '@', '#', ' ':
+		return true
+	}
+	return b < 0x20 || b == 0x7f
+}
+
+// ParseLine parses a single metric line, without a trailing newline.
+func ParseLine(line string) (Metric, error) {
+	fail := func(offset int, format string, args ...interface{}) (Metric, error) {
+		return Metric{}, &SyntaxError{Line: line, Offset: offset, Msg: fmt.Sprintf(format, args...)}
+	}
+
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return fail(len(line), "missing \":\" after bucket")
+	}
+	if colon == 0 {
+		return fail(0, "empty bucket")
+	}
+	for i := 0; i < colon; i++ {
+		if InvalidBucketByte(line[i]) {
+			return fail(i, "invalid character %q in bucket", line[i])
+		}
+	}
+	m := Metric{Bucket: line[:colon], Rate: 1}
+
+	offset := colon + 1
+	fields := strings.Split(line[offset:], "|")
+	if len(fields) < 2 {
+		return fail(len(line), "missing \"|\" after value")
+	}
+
+	m.Value = fields[0]
+	valueOffset := offset
+	offset += len(fields[0]) + 1
+
+	m.Type = Type(fields[1])
+	if !m.Type.valid() {
+		return fail(offset, "unknown type %q", fields[1])
+	}
+	if m.Value == "" {
+		return fail(valueOffset, "empty value")
+	}
+	if m.Type != Set {
+		f, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return fail(valueOffset, "invalid %s value %q", m.Type, m.Value)
+		}
+	}
+	offset += len(fields[1]) + 1
+
+	seenRate, seenTags := false, false
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@") && !seenRate:
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return fail(offset+1, "invalid sample rate %q", field[1:])
+			}
+			m.Rate = rate
+			seenRate = true
+		case strings.HasPrefix(field, "#") && !seenTags:
+			if field == "#" {
+				return fail(offset+1, "empty tags")
+			}
+			m.Tags = strings.Split(field[1:], ",")
+			tagOffset := offset + 1
+			for _, tag := range m.Tags {
+				if tag == "" {
+					return fail(tagOffset, "empty tag")
+				}
+				if i := strings.IndexAny(tag, "# \r\n\t"); i >= 0 {
+					return fail(tagOffset+i, "invalid character %q in tag", tag[i])
+				}
+				tagOffset += len(tag) + 1
+			}
+			seenTags = true
+		case field == "":
+			return fail(offset, "empty field")
+		default:
+			return fail(offset, "unexpected field %q", field)
+		}
+		offset += len(field) + 1
+	}
+	return m, nil
+}
+
+// ParsePacket parses every line of a packet. Empty lines, such as a trailing newline, are skipped.
+// Parsing stops at the first malformed line.
+func ParsePacket(packet string) ([]Metric, error) {
+	var metrics []Metric
+	for _, line := range strings.Split(packet, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		m, err := ParseLine(line)
+		if err != nil {
+			return metrics, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
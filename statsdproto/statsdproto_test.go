@@ -0,0 +1,137 @@
+package statsdproto
+
+import (
+	"reflect"
+	"testing"
+)
+
+var parseTests = []struct {
+	line     string
+	expected Metric
+}{
+	{"incr:1|c", Metric{Bucket: "incr", Value: "1", Type: Counter, Rate: 1}},
+	{"decr:-1|c|@0.99", Metric{Bucket: "decr", Value: "-1", Type: Counter, Rate: 0.99}},
+	{"gauge:300|g", Metric{Bucket: "gauge", Value: "300", Type: Gauge, Rate: 1}},
+	{"gauge:+10|g", Metric{Bucket: "gauge", Value: "+10", Type: Gauge, Rate: 1}},
+	{"gauge:-4|g", Metric{Bucket: "gauge", Value: "-4", Type: Gauge, Rate: 1}},
+	{"timing:123.456789|ms", Metric{Bucket: "timing", Value: "123.456789", Type: Timer, Rate: 1}},
+	{"unique:user-765|s", Metric{Bucket: "unique", Value: "user-765", Type: Set, Rate: 1}},
+	{"hist:12|h|#env:prod", Metric{Bucket: "hist", Value: "12", Type: Histogram, Rate: 1, Tags: []string{"env:prod"}}},
+	{"a.b.dist:0.5|d|@0.1|#env:prod,canary", Metric{Bucket: "a.b.dist", Value: "0.5", Type: Distribution, Rate: 0.1, Tags: []string{"env:prod", "canary"}}},
+	{"tags.first:1|c|#a|@0.5", Metric{Bucket: "tags.first", Value: "1", Type: Counter, Rate: 0.5, Tags: []string{"a"}}},
+}
+
+func TestParseLine(t *testing.T) {
+	for _, test := range parseTests {
+		m, err := ParseLine(test.line)
+		if err != nil {
+			t.Errorf("ParseLine(%q): %s", test.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, test.expected) {
+			t.Errorf("ParseLine(%q) = %+v, expected %+v", test.line, m, test.expected)
+		}
+	}
+}
+
+var parseErrorTests = []struct {
+	line   string
+	offset int
+	msg    string
+}{
+	{"incr", 4, `missing ":" after bucket`},
+	{":1|c", 0, "empty bucket"},
+	{"in cr:1|c", 2, `invalid character ' ' in bucket`},
+	{"incr:1", 6, `missing "|" after value`},
+	{"incr:1|x", 7, `unknown type "x"`},
+	{"incr:|c", 5, "empty value"},
+	{"incr:one|c", 5, `invalid c value "one"`},
+	{"incr:NaN|g", 5, `invalid g value "NaN"`},
+	{"incr:1|c|@2", 10, `invalid sample rate "2"`},
+	{"incr:1|c|@0", 10, `invalid sample rate "0"`},
+	{"incr:1|c|#", 10, "empty tags"},
+	{"incr:1|c|#a,,b", 12, "empty tag"},
+	{"incr:1|c|#a,b c", 13, `invalid character ' ' in tag`},
+	{"incr:1|c||#a", 9, "empty field"},
+	{"incr:1|c|@0.5|@0.5", 14, `unexpected field "@0.5"`},
+	{"incr:1|c|T1656581400", 9, `unexpected field "T1656581400"`},
+}
+
+func TestParseLineErrors(t *testing.T) {
+	for _, test := range parseErrorTests {
+		_, err := ParseLine(test.line)
+		syntaxErr, ok := err.(*SyntaxError)
+		if !ok {
+			t.Errorf("ParseLine(%q) returned %v, expected a *SyntaxError", test.line, err)
+			continue
+		}
+		if syntaxErr.Offset != test.offset || syntaxErr.Msg != test.msg {
+			t.Errorf("ParseLine(%q) failed with %q at %d, expected %q at %d",
+				test.line, syntaxErr.Msg, syntaxErr.Offset, test.msg, test.offset)
+		}
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	metrics, err := ParsePacket("incr:1|c\ngauge:+10|g\r\n\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Metric{
+		{Bucket: "incr", Value: "1", Type: Counter, Rate: 1},
+		{Bucket: "gauge", Value: "+10", Type: Gauge, Rate: 1},
+	}
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Fatalf("got %+v, expected %+v", metrics, expected)
+	}
+	if !metrics[1].IsDelta() || metrics[0].IsDelta() {
+		t.Error("only the gauge should be a delta")
+	}
+	if metrics[1].Float() != 10 {
+		t.Errorf("got %f for the gauge, expected 10", metrics[1].Float())
+	}
+
+	metrics, err = ParsePacket("incr:1|c\nbad\nincr:2|c")
+	if len(metrics) != 1 || err == nil {
+		t.Fatalf("got %+v and %v, expected the first metric and an error", metrics, err)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	metrics := []Metric{
+		{Bucket: "incr", Value: "1", Type: Counter, Rate: 1},
+		{Bucket: "decr", Value: "-1", Type: Counter, Rate: 0.25, Tags: []string{"env:prod", "canary"}},
+		{Bucket: "timing", Value: "350", Type: Timer},
+	}
+	expected := "incr:1|c\ndecr:-1|c|@0.25|#env:prod,canary\ntiming:350|ms"
+	if packet := Encode(metrics); packet != expected {
+		t.Fatalf("got %q, expected %q", packet, expected)
+	}
+}
+
+func FuzzParseLine(f *testing.F) {
+	for _, test := range parseTests {
+		f.Add(test.line)
+	}
+	for _, test := range parseErrorTests {
+		f.Add(test.line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		m, err := ParseLine(line)
+		if err != nil {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Fatalf("ParseLine(%q) returned %T, expected a *SyntaxError", line, err)
+			}
+			return
+		}
+
+		// whatever parses must encode to a line that parses the same
+		again, err := ParseLine(m.String())
+		if err != nil {
+			t.Fatalf("ParseLine(%q) of the encoded %q: %s", m.String(), line, err)
+		}
+		if !reflect.DeepEqual(m, again) {
+			t.Fatalf("%q parsed as %+v, encoded as %q which parsed as %+v", line, m, m.String(), again)
+		}
+	})
+}
@@ -0,0 +1,195 @@
+package statsdclient
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Tagger is a client that can send stats with DogStatsD tags of their own,
+// on top of the tags every stat is sent with.
+type Tagger interface {
+	// Tagged returns a client sending every stat with tags, in "key:value" or "value" form.
+	Tagged(tags ...string) StatsClient
+}
+
+// WithTags returns a client sending every stat to client with tags, and whether client supports tags.
+// When it does not, client itself is returned, and callers may put the tags in bucket names instead.
+func WithTags(client StatsClient, tags ...string) (StatsClient, bool) {
+	tagger, ok := client.(Tagger)
+	if !ok {
+		return client, false
+	}
+	return tagger.Tagged(tags...), true
+}
+
+// A TaggedClient sends stats through a Client with extra tags, see Client.Tagged.
+// It shares the connection, buffer and settings of the Client.
+type TaggedClient struct {
+	c    *Client
+	tags []string
+}
+
+// Tagged returns a client sending every stat through c with tags, on top of the ones set with SetTags.
+// Closing the returned client does nothing, close c instead.
+func (c *Client) Tagged(tags ...string) StatsClient {
+	return &TaggedClient{c: c, tags: tags}
+}
+
+// Tagged returns a client sending every stat with both the tags of t and tags.
+func (t *TaggedClient) Tagged(tags ...string) StatsClient {
+	return &TaggedClient{c: t.c, tags: append(append([]string(nil), t.tags...), tags...)}
+}
+
+// Set the key prefix of the underlying Client, see Client.SetPrefix.
+func (t *TaggedClient) SetPrefix(prefix string) {
+	t.c.SetPrefix(prefix)
+}
+
+// Increment the counter for the given bucket.
+func (t *TaggedClient) Increment(stat string, count int, rate float64) error {
+	return t.c.sendTagged(stat, rate, strconv.Itoa(count)+"|c", t.tags)
+}
+
+// Decrement the counter for the given bucket.
+func (t *TaggedClient) Decrement(stat string, count int, rate float64) error {
+	return t.Increment(stat, -count, rate)
+}
+
+// Record time spent for the given bucket with time.Duration.
+func (t *TaggedClient) Duration(stat string, duration time.Duration, rate float64) error {
+	return t.c.sendTagged(stat, rate, strconv.FormatFloat(duration.Seconds()*1000, 'f', 6, 64)+"|ms", t.tags)
+}
+
+// Record time spent for the given bucket in milliseconds.
+func (t *TaggedClient) Timing(stat string, delta int, rate float64) error {
+	return t.c.sendTagged(stat, rate, strconv.Itoa(delta)+"|ms", t.tags)
+}
+
+// Calculate time spent in given function and send it.
+func (t *TaggedClient) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return t.Duration(stat, time.Since(ts), rate)
+}
+
+// Record arbitrary values for the given bucket.
+func (t *TaggedClient) Gauge(stat string, value int, rate float64) error {
+	return t.c.sendTagged(stat, rate, strconv.Itoa(value)+"|g", t.tags)
+}
+
+// Increment the value of the gauge.
+func (t *TaggedClient) IncrementGauge(stat string, value int, rate float64) error {
+	return t.c.sendTagged(stat, rate, "+"+strconv.Itoa(value)+"|g", t.tags)
+}
+
+// Decrement the value of the gauge.
+func (t *TaggedClient) DecrementGauge(stat string, value int, rate float64) error {
+	return t.c.sendTagged(stat, rate, "-"+strconv.Itoa(value)+"|g", t.tags)
+}
+
+// Record unique occurences of events.
+func (t *TaggedClient) Unique(stat string, value int, rate float64) error {
+	return t.c.sendTagged(stat, rate, strconv.Itoa(value)+"|s", t.tags)
+}
+
+// Flush writes any buffered data of the underlying Client to the network.
+func (t *TaggedClient) Flush() error {
+	return t.c.Flush()
+}
+
+// Close does nothing, the underlying Client is closed by its owner.
+func (t *TaggedClient) Close() error {
+	return nil
+}
+
+// tagRecorder is implemented by the clients aggregating stats in memory, to record stats with tags.
+type tagRecorder interface {
+	SetPrefix(prefix string)
+	increment(stat string, count int, tags []string) error
+	duration(stat string, duration time.Duration, tags []string) error
+	gauge(stat string, value int, delta bool, tags []string) error
+	unique(stat string, value int, tags []string) error
+}
+
+// metricKey identifies an aggregated metric and its tags, encoded by tagKey.
+type metricKey struct {
+	name string
+	tags string
+}
+
+// tagKey encodes tags, sorted, so that they can be part of a map key.
+func tagKey(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, "\x00")
+}
+
+// splitTagKey decodes the tags of a key.
+func splitTagKey(tags string) []string {
+	if tags == "" {
+		return nil
+	}
+	return strings.Split(tags, "\x00")
+}
+
+// taggedRecorder records stats with tags through a tagRecorder, for its Tagged method.
+type taggedRecorder struct {
+	r    tagRecorder
+	tags []string
+}
+
+func (t *taggedRecorder) Tagged(tags ...string) StatsClient {
+	return &taggedRecorder{r: t.r, tags: append(append([]string(nil), t.tags...), tags...)}
+}
+
+func (t *taggedRecorder) SetPrefix(prefix string) {
+	t.r.SetPrefix(prefix)
+}
+
+func (t *taggedRecorder) Increment(stat string, count int, rate float64) error {
+	return t.r.increment(stat, count, t.tags)
+}
+
+func (t *taggedRecorder) Decrement(stat string, count int, rate float64) error {
+	return t.r.increment(stat, -count, t.tags)
+}
+
+func (t *taggedRecorder) Duration(stat string, duration time.Duration, rate float64) error {
+	return t.r.duration(stat, duration, t.tags)
+}
+
+func (t *taggedRecorder) Timing(stat string, delta int, rate float64) error {
+	return t.r.duration(stat, time.Duration(delta)*time.Millisecond, t.tags)
+}
+
+func (t *taggedRecorder) Time(stat string, rate float64, f func()) error {
+	ts := time.Now()
+	f()
+	return t.Duration(stat, time.Since(ts), rate)
+}
+
+func (t *taggedRecorder) Gauge(stat string, value int, rate float64) error {
+	return t.r.gauge(stat, value, false, t.tags)
+}
+
+func (t *taggedRecorder) IncrementGauge(stat string, value int, rate float64) error {
+	return t.r.gauge(stat, value, true, t.tags)
+}
+
+func (t *taggedRecorder) DecrementGauge(stat string, value int, rate float64) error {
+	return t.r.gauge(stat, -value, true, t.tags)
+}
+
+func (t *taggedRecorder) Unique(stat string, value int, rate float64) error {
+	return t.r.unique(stat, value, t.tags)
+}
+
+// Close does nothing, the client is closed by its owner.
+func (t *taggedRecorder) Close() error {
+	return nil
+}
@@ -0,0 +1,62 @@
+package statsdclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestTaggedClient(t *testing.T) {
+	c := NewMockClient()
+	c.SetPrefix("app")
+	c.SetTags("env:prod")
+
+	tagged := c.Tagged("host:a")
+	tagged.Increment("incr", 1, 1)
+	tagged.Duration("time", 1500*time.Microsecond, 1)
+	tagged.(*TaggedClient).Tagged("route:b").Gauge("gauge", 3, 1)
+	c.Unique("unique", 4, 1)
+
+	var lines []string
+	for {
+		line, err := c.NextStat()
+		if err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{
+		"app.incr:1|c|#env:prod,host:a",
+		"app.time:1.500000|ms|#env:prod,host:a",
+		"app.gauge:3|g|#env:prod,host:a,route:b",
+		"app.unique:4|s|#env:prod",
+	}, lines)
+
+	// closing the tagged client leaves the client open
+	assert.Equal(t, nil, tagged.Close())
+	assert.Equal(t, nil, c.Increment("incr", 1, 1))
+}
+
+func TestTaggedClientSanitize(t *testing.T) {
+	c := NewMockClient()
+	c.Tagged("bad|tag").Increment("incr", 1, 1)
+	stat, _ := c.NextStat()
+	assert.Equal(t, "incr:1|c|#bad_tag", stat)
+
+	c.SetSanitizer(SanitizeReject)
+	assert.Equal(t, ErrInvalidName, c.Tagged("bad|tag").Increment("incr", 1, 1))
+}
+
+func TestWithTags(t *testing.T) {
+	c := NewMockClient()
+	tagged, ok := WithTags(c, "a:b")
+	assert.T(t, ok, "a Client supports tags")
+	tagged.Increment("incr", 1, 1)
+	stat, _ := c.NextStat()
+	assert.Equal(t, "incr:1|c|#a:b", stat)
+
+	untagged, ok := WithTags(NullStatsClient, "a:b")
+	assert.T(t, !ok, "NullStatsClient does not support tags")
+	assert.Equal(t, NullStatsClient, untagged)
+}
@@ -0,0 +1,110 @@
+package statsdclient
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tcpDialTimeout = time.Second
+
+// tcpConn sends packets over TCP, ending each with a newline so the server can tell them apart.
+// The connection is dialed on the first write, and again on the write after an error or after the
+// server closed it.
+//
+// Statsd servers never reply, so the connection is read from only to notice the server closing it.
+// A write after that is made on a new connection instead of being accepted by the kernel and lost.
+// A server that goes away without closing the connection, because it crashed or the network is cut,
+// is only noticed once a write fails: the packets written until then are lost.
+type tcpConn struct {
+	raddr string
+	ip    net.IP
+
+	m    sync.Mutex
+	conn net.Conn
+	// Closed once the server closes conn
+	eof chan struct{}
+
+	// conn as well, and the deadline applied to it, for SetWriteDeadline to use while a write holds m
+	current  atomic.Pointer[net.Conn]
+	deadline atomic.Pointer[time.Time]
+}
+
+func newTCPConn(raddr string) (*tcpConn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpConn{raddr: raddr, ip: addr.IP}, nil
+}
+
+func (t *tcpConn) remoteIP() net.IP {
+	return t.ip
+}
+
+func (t *tcpConn) Write(p []byte) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.conn != nil {
+		select {
+		case <-t.eof:
+			t.conn.Close()
+			t.conn = nil
+		default:
+		}
+	}
+	if t.conn == nil {
+		dialer := net.Dialer{Timeout: tcpDialTimeout, Deadline: t.writeDeadline()}
+		conn, err := dialer.Dial("tcp", t.raddr)
+		if err != nil {
+			return 0, err
+		}
+		// stored before reading the deadline, so that a concurrent SetWriteDeadline is not missed
+		t.current.Store(&conn)
+		conn.SetWriteDeadline(t.writeDeadline())
+		eof := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(eof)
+		}()
+		t.conn = conn
+		t.eof = eof
+	}
+
+	if _, err := t.conn.Write(append(p[:len(p):len(p)], '\n')); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (t *tcpConn) writeDeadline() time.Time {
+	if deadline := t.deadline.Load(); deadline != nil {
+		return *deadline
+	}
+	return time.Time{}
+}
+
+// SetWriteDeadline sets the deadline of the writes to this connection and the ones dialed after it,
+// including a write in progress.
+func (t *tcpConn) SetWriteDeadline(deadline time.Time) error {
+	t.deadline.Store(&deadline)
+	if conn := t.current.Load(); conn != nil {
+		return (*conn).SetWriteDeadline(deadline)
+	}
+	return nil
+}
+
+func (t *tcpConn) Close() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -1,3 +1,3 @@
 package statsdclient
 
-const VERSION = "3.3.0"
+const VERSION = "3.29.0"
@@ -1,36 +1,98 @@
 package statsdclient
 
-import "net"
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// errNoAddress is returned when a Resolver finds no address and no error.
+var errNoAddress = errors.New("Resolver returned no address")
 
 type writeToConn struct {
-	remoteAddr *net.UDPAddr
+	// The unresolved address, and the *net.UDPAddr it currently resolves to
+	raddr      string
+	remoteAddr atomic.Value
 
 	udpConn *net.UDPConn
+
+	resolver func(network, addr string) (*net.UDPAddr, error)
+
+	done chan struct{}
 }
 
-func newWriteToConn(raddr string) (*writeToConn, error) {
+func newWriteToConn(raddr string, resolver func(network, addr string) (*net.UDPAddr, error)) (*writeToConn, error) {
 	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
 	if err != nil {
 		return nil, err
 	}
 
-	remoteAddr, err := net.ResolveUDPAddr("udp", raddr)
-	if err != nil {
+	conn := &writeToConn{
+		raddr:    raddr,
+		udpConn:  udpConn,
+		resolver: resolver,
+	}
+	if err := conn.resolve(); err != nil {
+		udpConn.Close()
 		return nil, err
 	}
+	return conn, nil
+}
 
-	conn := &writeToConn{
-		udpConn:    udpConn,
-		remoteAddr: remoteAddr,
+// resolve looks up raddr and sends to the address found. On failure the address is left unchanged.
+func (w *writeToConn) resolve() error {
+	addr, err := w.resolver("udp", w.raddr)
+	if err == nil && addr == nil {
+		err = errNoAddress
 	}
-	return conn, nil
+	if err != nil {
+		return err
+	}
+	w.remoteAddr.Store(addr)
+	return nil
+}
+
+func (w *writeToConn) addr() *net.UDPAddr {
+	return w.remoteAddr.Load().(*net.UDPAddr)
+}
+
+func (w *writeToConn) remoteIP() net.IP {
+	return w.addr().IP
+}
+
+// startResolving resolves raddr again every interval.
+// The socket is not connected, so that a server that went away causes no write errors, which
+// leaves the interval as the only way to notice it moved.
+func (w *writeToConn) startResolving(interval time.Duration) {
+	w.done = make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.done:
+				return
+			}
+			// keep sending to the old address if the lookup fails
+			w.resolve()
+		}
+	}()
 }
 
 func (w *writeToConn) Write(p []byte) (int, error) {
-	n, err := w.udpConn.WriteToUDP(p, w.remoteAddr)
-	return n, err
+	return w.udpConn.WriteToUDP(p, w.addr())
+}
+
+func (w *writeToConn) SetWriteDeadline(deadline time.Time) error {
+	return w.udpConn.SetWriteDeadline(deadline)
 }
 
 func (w *writeToConn) Close() error {
+	if w.done != nil {
+		close(w.done)
+	}
 	return w.udpConn.Close()
 }
@@ -0,0 +1,122 @@
+package statsdclient
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// fakeResolver resolves every address to whatever was set last.
+type fakeResolver struct {
+	m     sync.Mutex
+	addr  *net.UDPAddr
+	calls int
+}
+
+func (r *fakeResolver) set(addr net.Addr) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.addr = addr.(*net.UDPAddr)
+}
+
+func (r *fakeResolver) clear() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.addr = nil
+}
+
+func (r *fakeResolver) resolve(network, addr string) (*net.UDPAddr, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.calls++
+	return r.addr, nil
+}
+
+func (r *fakeResolver) callCount() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.calls
+}
+
+func listenUDP(t *testing.T) *net.UDPConn {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// receives reports whether listener gets a packet within timeout.
+func receives(listener *net.UDPConn, timeout time.Duration) bool {
+	listener.SetReadDeadline(time.Now().Add(timeout))
+	_, err := listener.Read(make([]byte, PacketSizeLoopback))
+	return err == nil
+}
+
+func TestResolveInterval(t *testing.T) {
+	oldServer := listenUDP(t)
+	defer oldServer.Close()
+	newServer := listenUDP(t)
+	defer newServer.Close()
+
+	resolver := &fakeResolver{}
+	resolver.set(oldServer.LocalAddr())
+	c, err := DialConfig(Config{
+		Addr:            "statsd:8125",
+		ResolveInterval: 10 * time.Millisecond,
+		Resolver:        resolver.resolve,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Increment("incr", 1, 1)
+	assert.Equal(t, err, nil)
+	err = c.Flush()
+	assert.Equal(t, err, nil)
+	assert.T(t, receives(oldServer, time.Second), "old server did not receive the stat")
+
+	resolver.set(newServer.LocalAddr())
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatal("client never moved to the new server")
+		}
+		c.Increment("incr", 1, 1)
+		c.Flush()
+		if receives(newServer, 20*time.Millisecond) {
+			break
+		}
+	}
+}
+
+func TestResolverNoAddress(t *testing.T) {
+	server := listenUDP(t)
+	defer server.Close()
+
+	resolver := &fakeResolver{}
+	_, err := DialConfig(Config{Addr: "statsd:8125", Resolver: resolver.resolve})
+	assert.Equal(t, errNoAddress, err)
+
+	resolver.set(server.LocalAddr())
+	c, err := DialConfig(Config{
+		Addr:            "statsd:8125",
+		ResolveInterval: time.Millisecond,
+		Resolver:        resolver.resolve,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	resolver.clear()
+	for calls := resolver.callCount(); resolver.callCount() < calls+2; {
+		time.Sleep(time.Millisecond)
+	}
+	c.Increment("incr", 1, 1)
+	assert.Equal(t, nil, c.Flush())
+	assert.T(t, receives(server, time.Second), "the client should keep its previous address")
+}